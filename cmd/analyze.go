@@ -0,0 +1,275 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Kinds of missing things a log pattern can detect
+const (
+	missingHeader    = "header"
+	missingPkgConfig = "pkg-config module"
+	missingLibrary   = "library"
+	missingCommand   = "command"
+	missingPackage   = "package"
+)
+
+// logPattern matches a build log line, the first group of Regexp is the name of what is missing
+type logPattern struct {
+	Kind   string `json:"kind"`
+	Regexp string `json:"regexp"`
+	re     *regexp.Regexp
+}
+
+// patternDB is the pattern database, barrells extend it with a log-patterns.json file of the same shape
+type patternDB struct {
+	Patterns []logPattern `json:"patterns"`
+	// Aliases map a header, module, library or command to the barrell providing it
+	Aliases map[string]string `json:"aliases"`
+}
+
+// patternFile is the name of the pattern database extension in the barrells directory
+const patternFile = "log-patterns.json"
+
+var defaultPatterns = patternDB{
+	Patterns: []logPattern{
+		//gcc and clang
+		{Kind: missingHeader, Regexp: `fatal error: ([\w./+-]+\.h(?:pp|h)?): No such file or directory`},
+		{Kind: missingHeader, Regexp: `fatal error: '([\w./+-]+\.h(?:pp|h)?)' file not found`},
+		//configure
+		{Kind: missingHeader, Regexp: `configure: error: .*header file <?([\w./+-]+\.h)>?`},
+		{Kind: missingPkgConfig, Regexp: `No package '([\w.+-]+)' found`},
+		{Kind: missingPkgConfig, Regexp: `Package '?([\w.+-]+?)'?,? (?:was not found|not found)`},
+		{Kind: missingLibrary, Regexp: `configure: error: .*\blib([\w+-]+) (?:not found|is required)`},
+		{Kind: missingCommand, Regexp: `configure: error: (?:no acceptable )?([\w+-]+) (?:not found|could be found|is required)`},
+		//cmake
+		{Kind: missingPackage, Regexp: `Could NOT find ([\w+-]+)`},
+		{Kind: missingPackage, Regexp: `By not providing "Find([\w+-]+)\.cmake"`},
+		{Kind: missingPkgConfig, Regexp: `(?:A required package|The following required packages) was not found:?\s*-?\s*([\w.+-]+)`},
+		//meson
+		{Kind: missingPkgConfig, Regexp: `Dependency "?([\w.+-]+)"? not found`},
+		{Kind: missingPkgConfig, Regexp: `Run-time dependency ([\w.+-]+) found: NO`},
+		{Kind: missingCommand, Regexp: `Program '?([\w.+-]+)'? not found`},
+		//ld
+		{Kind: missingLibrary, Regexp: `cannot find -l([\w.+-]+)`},
+		{Kind: missingLibrary, Regexp: `library not found for -l([\w.+-]+)`},
+		{Kind: missingLibrary, Regexp: `error while loading shared libraries: lib([\w+-]+)\.so`},
+		//shell
+		{Kind: missingCommand, Regexp: `([\w.+-]+): command not found`},
+		{Kind: missingCommand, Regexp: `sh: \d+: ([\w.+-]+): not found`},
+		{Kind: missingCommand, Regexp: `exec: "([\w.+-]+)": executable file not found`},
+	},
+	Aliases: map[string]string{
+		"ssl":        "openssl",
+		"crypto":     "openssl",
+		"libssl":     "openssl",
+		"libcrypto":  "openssl",
+		"z":          "zlib",
+		"zlib.h":     "zlib",
+		"bz2":        "bzip2",
+		"bzlib.h":    "bzip2",
+		"lzma":       "xz",
+		"liblzma":    "xz",
+		"ffi":        "libffi",
+		"ffi.h":      "libffi",
+		"png":        "libpng",
+		"jpeg":       "libjpeg",
+		"libcurl":    "curl",
+		"ncursesw":   "ncurses",
+		"curses.h":   "ncurses",
+		"sqlite3":    "sqlite",
+		"sqlite3.h":  "sqlite",
+		"xml2":       "libxml2",
+		"pcre2-8":    "pcre2",
+		"yaml":       "libyaml",
+		"yaml-0.1":   "libyaml",
+		"uuid":       "libuuid",
+		"iconv":      "libiconv",
+		"intl":       "gettext",
+		"libintl.h":  "gettext",
+		"msgfmt":     "gettext",
+		"autoreconf": "autoconf",
+		"aclocal":    "automake",
+		"libtoolize": "libtool",
+		"makeinfo":   "texinfo",
+		"python":     "python3",
+	},
+}
+
+// missingDependency is something a build log shows missing, with the barrell that provides it if any
+type missingDependency struct {
+	Kind    string
+	Name    string
+	Line    string
+	Barrell string
+}
+
+// loadPatterns returns the default patterns merged with the log-patterns.json of the barrells directory
+func loadPatterns(barrellsLoc string) (patternDB, error) {
+	db := patternDB{Aliases: make(map[string]string)}
+	db.Patterns = append(db.Patterns, defaultPatterns.Patterns...)
+	for k, v := range defaultPatterns.Aliases {
+		db.Aliases[k] = v
+	}
+	content, err := os.ReadFile(filepath.Join(barrellsLoc, patternFile))
+	if err != nil && !os.IsNotExist(err) {
+		return db, err
+	}
+	if err == nil {
+		var extra patternDB
+		if err := json.Unmarshal(content, &extra); err != nil {
+			return db, fmt.Errorf("%s: %s", patternFile, err)
+		}
+		//patterns from the barrells come first so they can override a default match
+		db.Patterns = append(extra.Patterns, db.Patterns...)
+		for k, v := range extra.Aliases {
+			db.Aliases[k] = v
+		}
+	}
+	for i := range db.Patterns {
+		db.Patterns[i].re, err = regexp.Compile(db.Patterns[i].Regexp)
+		if err != nil {
+			return db, fmt.Errorf("pattern %q: %s", db.Patterns[i].Regexp, err)
+		}
+	}
+	return db, nil
+}
+
+// analyzeLog finds the dependencies the build log at logPath shows missing
+func analyzeLog(logPath string, barrellsLoc string) ([]missingDependency, error) {
+	db, err := loadPatterns(barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var missing []missingDependency
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, p := range db.Patterns {
+			match := p.re.FindStringSubmatch(line)
+			if len(match) < 2 {
+				continue
+			}
+			key := p.Kind + ":" + match[1]
+			if !seen[key] {
+				seen[key] = true
+				missing = append(missing, missingDependency{
+					Kind:    p.Kind,
+					Name:    match[1],
+					Line:    strings.TrimSpace(line),
+					Barrell: findBarrell(match[1], db.Aliases, barrellsLoc),
+				})
+			}
+			break
+		}
+	}
+	return missing, scanner.Err()
+}
+
+// versionSuffix matches versions in pkg-config module names such as glib-2.0
+var versionSuffix = regexp.MustCompile(`-?[\d.]+$`)
+
+// findBarrell maps a missing header, module, library or command to a barrell in barrellsLoc
+func findBarrell(name string, aliases map[string]string, barrellsLoc string) string {
+	var candidates []string
+	add := func(c string) {
+		if c != "" {
+			candidates = append(candidates, c)
+			if alias, ok := aliases[c]; ok {
+				candidates = append(candidates, alias)
+			}
+		}
+	}
+	add(name)
+	if strings.Contains(name, "/") {
+		//openssl/ssl.h is provided by openssl
+		add(strings.Split(name, "/")[0])
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(filepath.Base(name), ".hpp"), ".hh"), ".h")
+	add(base)
+	add(versionSuffix.ReplaceAllString(base, ""))
+	add(strings.TrimPrefix(base, "lib"))
+	add("lib" + base)
+	for _, c := range candidates {
+		barrell := convertToReadableString(strings.ToLower(c))
+		if doesExist(filepath.Join(barrellsLoc, barrell+".py")) {
+			return barrell
+		}
+	}
+	return ""
+}
+
+// suggestedSet returns the dependency set a missing thing of kind belongs in
+// Commands and headers are only needed to build, libraries are linked so the package needs them at runtime too
+func suggestedSet(kind string) string {
+	switch kind {
+	case missingCommand, missingHeader:
+		return buildDependencies
+	}
+	return runtimeDependencies
+}
+
+// suggestDependencies prints what to add to the dependencies of pkg after its build failed
+// Returns the suggestions so they can be added to the build report
+func suggestDependencies(path string, pkg string, logPath string, barrellsLoc string) []string {
+	missing, err := analyzeLog(logPath, barrellsLoc)
+	if err != nil {
+		color.Yellow("WARNING - ANALYZE: %s", err)
+		return nil
+	}
+	//only the dependencies installed for the build count, test dependencies are not there yet
+	specs, err := dependenciesFor(path, pkg, buildSets...)
+	if err != nil {
+		color.Yellow("WARNING - ANALYZE: %s", err)
+		return nil
+	}
+	declared := make(map[string]bool)
+	for _, dep := range specs {
+		declared[dependencyPackage(dep)] = true
+	}
+	testSpecs, err := getDependencySet(path, pkg, testDependencies)
+	if err != nil {
+		color.Yellow("WARNING - ANALYZE: %s", err)
+		return nil
+	}
+	testOnly := make(map[string]bool)
+	for _, dep := range testSpecs {
+		testOnly[dependencyPackage(dep)] = !declared[dependencyPackage(dep)]
+	}
+	var suggestions []string
+	for _, m := range missing {
+		var suggestion string
+		switch {
+		case m.Barrell == pkg:
+			continue
+		case m.Barrell == "":
+			suggestion = fmt.Sprintf("missing %s %s, no barrell provides it", m.Kind, m.Name)
+		case declared[m.Barrell]:
+			suggestion = fmt.Sprintf("missing %s %s, `%s` is already a dependency, check that it is installed", m.Kind, m.Name, m.Barrell)
+		case testOnly[m.Barrell]:
+			suggestion = fmt.Sprintf("move `%s` from %s to %s, it is needed to build (missing %s %s)", m.Barrell, testDependencies, suggestedSet(m.Kind), m.Kind, m.Name)
+		default:
+			suggestion = fmt.Sprintf("add `%s` to %s (missing %s %s)", m.Barrell, suggestedSet(m.Kind), m.Kind, m.Name)
+		}
+		color.Yellow("SUGGESTION: %s", suggestion)
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions
+}
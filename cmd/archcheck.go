@@ -0,0 +1,207 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Magic numbers used to sniff a file before handing it to debug/elf or debug/macho
+const (
+	elfMagic      = "\x7fELF"
+	machoMagic32  = 0xfeedface
+	machoMagic64  = 0xfeedfacf
+	machoCigam32  = 0xcefaedfe
+	machoCigam64  = 0xcffaedfe
+	machoFatMagic = 0xcafebabe
+)
+
+// binaryInfo describes the machine types found in a single ELF or Mach-O file
+type binaryInfo struct {
+	Path   string
+	Format string
+	Arches []string
+}
+
+// archMismatch is a binary whose machine type does not match the target arch
+type archMismatch struct {
+	binaryInfo
+	Want string
+}
+
+func elfArch(m elf.Machine) string {
+	switch m {
+	case elf.EM_X86_64:
+		return "amd64"
+	case elf.EM_AARCH64:
+		return "arm64"
+	case elf.EM_386:
+		return "386"
+	case elf.EM_ARM:
+		return "arm"
+	}
+	return m.String()
+}
+func machoArch(c macho.Cpu) string {
+	switch c {
+	case macho.CpuAmd64:
+		return "amd64"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.Cpu386:
+		return "386"
+	case macho.CpuArm:
+		return "arm"
+	}
+	return c.String()
+}
+
+// readBinaryInfo sniffs path and returns its machine types
+// ok is false for files that are not ELF or Mach-O, which are arch independent
+func readBinaryInfo(path string) (info binaryInfo, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return info, false, err
+	}
+	defer f.Close()
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		//too small to be a binary
+		return info, false, nil
+	}
+	info.Path = path
+	if string(magic[:]) == elfMagic {
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return info, false, nil
+		}
+		info.Format = "ELF"
+		info.Arches = []string{elfArch(ef.Machine)}
+		return info, true, nil
+	}
+	switch binary.BigEndian.Uint32(magic[:]) {
+	case machoMagic32, machoMagic64, machoCigam32, machoCigam64:
+		mf, err := macho.NewFile(f)
+		if err != nil {
+			return info, false, nil
+		}
+		info.Format = "Mach-O"
+		info.Arches = []string{machoArch(mf.Cpu)}
+		return info, true, nil
+	case machoFatMagic:
+		//java class files share the fat magic, those fail to parse and are skipped
+		ff, err := macho.NewFatFile(f)
+		if err != nil {
+			return info, false, nil
+		}
+		info.Format = "Mach-O (fat)"
+		for _, a := range ff.Arches {
+			info.Arches = append(info.Arches, machoArch(a.Cpu))
+		}
+		return info, true, nil
+	}
+	return info, false, nil
+}
+
+// walkBinaries calls fn for every ELF or Mach-O file below root
+// Symlinks are not followed
+func walkBinaries(root string, fn func(info binaryInfo) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, ok, err := readBinaryInfo(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		return fn(info)
+	})
+}
+
+// verifyArch walks root and returns every binary that does not match arch
+// An empty arch is a default build for the host arch, a universal target only accepts fat binaries containing both amd64 and arm64
+func verifyArch(root string, arch string) ([]archMismatch, error) {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	var mismatches []archMismatch
+	err := walkBinaries(root, func(info binaryInfo) error {
+		if !archMatches(info, arch) {
+			mismatches = append(mismatches, archMismatch{binaryInfo: info, Want: arch})
+		}
+		return nil
+	})
+	return mismatches, err
+}
+func archMatches(info binaryInfo, arch string) bool {
+	if arch == "universal" {
+		if info.Format != "Mach-O (fat)" {
+			return false
+		}
+		return containsString(info.Arches, "amd64") && containsString(info.Arches, "arm64")
+	}
+	for _, a := range info.Arches {
+		if a != arch {
+			return false
+		}
+	}
+	return true
+}
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkArch verifies the staged tree of pkg against arch
+// Returns an error when a mismatch is found unless allowMismatch is set, in which case it only warns
+func checkArch(pkg string, arch string, allowMismatch bool) error {
+	root := workspaceDir(pkg)
+	mismatches, err := verifyArch(root, arch)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		rel, err := filepath.Rel(root, m.Path)
+		if err != nil {
+			rel = m.Path
+		}
+		msg := fmt.Sprintf("%s: %s built for %s, expected %s", rel, m.Format, strings.Join(m.Arches, ","), m.Want)
+		if allowMismatch {
+			color.Yellow("WARNING - ARCH CHECK: %s", msg)
+		} else {
+			color.Red("ERROR - ARCH CHECK: %s", msg)
+		}
+	}
+	if len(mismatches) > 0 && !allowMismatch {
+		return fmt.Errorf("%d binaries do not match the target arch, use --allow-arch-mismatch to ignore", len(mismatches))
+	}
+	return nil
+}
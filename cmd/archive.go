@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// compress archives <inputPath> in the workspace into outputPath
+// The archive is deterministic so identical inputs produce byte identical files
+func compress(outputPath string, inputPath string) {
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		color.Red("ERROR - COMPRESS: %s", err)
+		os.Exit(1)
+	}
+	err = writeArchive(outputPath, workspaceRoot, inputPath, epoch)
+	if err != nil {
+		color.Red("ERROR - COMPRESS: %s", err)
+		os.Exit(1)
+	}
+}
+
+// sourceDateEpoch reads SOURCE_DATE_EPOCH, see https://reproducible-builds.org/specs/source-date-epoch/
+// Defaults to the unix epoch when unset
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// writeArchive writes root/name into a gzipped tarball at outputPath
+// Entries are sorted, mtimes are clamped to epoch and ownership is reset to 0/0
+func writeArchive(outputPath string, root string, name string, epoch time.Time) error {
+	var paths []string
+	err := filepath.WalkDir(filepath.Join(root, name), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	for _, rel := range paths {
+		if err := writeArchiveEntry(tw, root, rel, epoch); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// tarMode returns the permission bits of mode with setuid, setgid and sticky as tar stores them
+func tarMode(mode fs.FileMode) int64 {
+	bits := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+func writeArchiveEntry(tw *tar.Writer, root string, rel string, epoch time.Time) error {
+	path := filepath.Join(root, rel)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	modTime := info.ModTime().Truncate(time.Second)
+	if modTime.After(epoch) {
+		modTime = epoch
+	}
+	hdr := &tar.Header{
+		Name:    filepath.ToSlash(rel),
+		Mode:    tarMode(info.Mode()),
+		ModTime: modTime,
+	}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case info.Mode()&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+	default:
+		//sockets, fifos and devices have no place in a prebuild
+		return nil
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(tw, file, hdr.Size)
+	return err
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"io/fs"
+	"testing"
+)
+
+func TestTarModeMatchesManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     fs.FileMode
+		typeflag byte
+		want     string
+	}{
+		{"regular", 0644, tar.TypeReg, "-rw-r--r--"},
+		{"executable", 0755, tar.TypeReg, "-rwxr-xr-x"},
+		{"setuid", fs.ModeSetuid | 0755, tar.TypeReg, "urwxr-xr-x"},
+		{"setgid", fs.ModeSetgid | 0750, tar.TypeReg, "grwxr-x---"},
+		{"sticky dir", fs.ModeDir | fs.ModeSticky | 0777, tar.TypeDir, "dtrwxrwxrwx"},
+		{"symlink", fs.ModeSymlink | 0777, tar.TypeSymlink, "Lrwxrwxrwx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manifestMode(tt.mode); got != tt.want {
+				t.Fatalf("manifestMode(%v) = %s, want %s", tt.mode, got, tt.want)
+			}
+			hdr := &tar.Header{Name: "f", Mode: tarMode(tt.mode), Typeflag: tt.typeflag}
+			if got := manifestMode(hdr.FileInfo().Mode()); got != tt.want {
+				t.Fatalf("mode read back from the archive is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,12 +5,12 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
-	"strconv"
 
 	"io"
 	"log"
@@ -19,6 +19,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -32,8 +33,11 @@ import (
 
 // buildCmd represents the build command
 var barrellsloc string
+
+// workspaceRoot is where packages are downloaded and built
+var workspaceRoot = "/tmp/fermenter"
 var buildCmd = &cobra.Command{
-	Use:   "build <package>",
+	Use:   "build <package>...",
 	Short: "Build and upload prebuilds",
 	Long:  `Build and upload prebuilds to the server holding other prebuilds`,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -46,18 +50,65 @@ var buildCmd = &cobra.Command{
 		if err != nil {
 			panic(err)
 		}
-		useExisting, err := cmd.Flags().GetBool("use-existing")
+		universal, err := cmd.Flags().GetBool("universal")
 		if err != nil {
 			panic(err)
 		}
-		noupload, err := cmd.Flags().GetBool("no-upload")
+		if universal && dualarch {
+			color.Red("ERROR: --universal and --dual-arch can not be used together")
+			os.Exit(1)
+		}
+		sel, err := readPhaseSelection(cmd)
 		if err != nil {
-			panic(err)
+			color.Red("ERROR: %s", err)
+			os.Exit(1)
 		}
 		if dir, err := isDir(barrellsLoc); err != nil || !dir {
 			color.Red("ERROR: Barrells location is not a directory or does not exist")
 			os.Exit(1)
 		}
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			panic(err)
+		}
+		changedSince, err := cmd.Flags().GetString("changed-since")
+		if err != nil {
+			panic(err)
+		}
+		jobs, err := cmd.Flags().GetInt("jobs")
+		if err != nil {
+			panic(err)
+		}
+		rdeps, err := cmd.Flags().GetString("rdeps")
+		if err != nil {
+			panic(err)
+		}
+		if all || changedSince != "" || rdeps != "" || len(args) > 1 {
+			pkgs := args
+			switch {
+			case all:
+				pkgs, err = allBarrells(barrellsLoc)
+			case changedSince != "":
+				pkgs, err = changedBarrells(barrellsLoc, changedSince)
+			case rdeps != "":
+				pkgs, err = withReverseDependencies(convertToReadableString(strings.ToLower(rdeps)), barrellsLoc)
+			}
+			if err != nil {
+				color.Red("ERROR: %s", err)
+				os.Exit(1)
+			}
+			for i := range pkgs {
+				pkgs[i] = convertToReadableString(pkgs[i])
+			}
+			if debug, _ := cmd.Flags().GetBool("debug-on-failure"); debug {
+				color.Yellow("WARNING: --debug-on-failure is ignored when building several packages")
+			}
+			if len(pkgs) == 0 {
+				color.Yellow("Nothing to build")
+				os.Exit(0)
+			}
+			os.Exit(buildMany(cmd, pkgs, barrellsLoc, jobs))
+		}
 		if len(args) < 1 {
 			color.Red("ERROR: Please specify a package to build")
 			os.Exit(1)
@@ -71,41 +122,45 @@ var buildCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		color.Green("Found package %s\n", pkg)
-		if !useExisting {
-			dep := getDependencies(pkg, args[0])
-			installDependencies(dep, pkg, barrellsLoc)
-			if !dualarch && !checkIfPackageIsDualArch(pkg) {
-				downloadsource(args[0], barrellsLoc)
-				doneBuilding := make(chan bool)
-				go magicWatcher(args[0], doneBuilding)
-				runBuildCommand(pkg, args[0], "")
-				doneBuilding <- true
-				os.Exit(0)
-			} else {
-				for _, arch := range []string{"amd64", "arm64"} {
-					fmt.Println("Building for arch:", arch)
-					downloadsource(args[0], barrellsLoc)
-					doneBuilding := make(chan bool)
-					go magicWatcher(args[0], doneBuilding)
-					runBuildCommand(pkg, args[0], arch)
-
-					installPKG(args[0], barrellsLoc)
-					doneBuilding <- true
-					if !noupload {
-						uploadtoapi(args[0], arch)
-					}
-					//clena up
-
-					os.Remove(fmt.Sprintf("/tmp/fermenter/%s", args[0]))
-				}
-				os.Exit(0)
+		cache := newBuildCache(cmd)
+		opts, err := readBuildOptions(cmd)
+		if err != nil {
+			color.Red("ERROR: %s", err)
+			os.Exit(1)
+		}
+		var targets []*buildTarget
+		switch {
+		case universal:
+			targets = append(targets, newBuildTarget(pkg, args[0], "", true, workspaceRoot, opts))
+		case dualarch || checkIfPackageIsDualArch(pkg):
+			for _, arch := range []string{"amd64", "arm64"} {
+				targets = append(targets, newBuildTarget(pkg, args[0], arch, false, filepath.Join(workspaceRoot, arch), opts))
 			}
-
+		default:
+			targets = append(targets, newBuildTarget(pkg, args[0], "", false, workspaceRoot, opts))
 		}
-		if !noupload {
-			uploadtoapi(args[0], "")
+		allCached := true
+		var reports []buildReport
+		var archives []string
+		for _, target := range targets {
+			if target.Arch != "" {
+				fmt.Println("Building for arch:", target.Arch)
+			}
+			cached, err := runPipeline(target, sel, cache)
+			allCached = cached && allCached
+			reports = append(reports, newBuildReport(target))
+			if err := writeReports(target, reports, opts.Report); err != nil {
+				color.Yellow("WARNING - REPORT: %s", err)
+			}
+			if err != nil {
+				color.Red("ERROR - %s", err)
+				os.Exit(1)
+			}
+			if archive := target.State.Outputs["archive"]; archive != "" {
+				archives = append(archives, archive)
+			}
 		}
-
+		writeBuildStatus(cmd, buildStatus(allCached), archives)
 	},
 }
 
@@ -126,20 +181,37 @@ func init() {
 	}
 	location = location[:len(location)-len("/fermenter")]
 	buildCmd.Flags().String("barrells", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
-	buildCmd.Flags().BoolP("use-existing", "E", false, "Use existing build")
+	buildCmd.Flags().BoolP("use-existing", "E", false, "Use existing build, same as --from compress")
 	buildCmd.Flags().BoolP("no-upload", "n", false, "Build but do not upload to the server")
 	buildCmd.Flags().BoolP("dual-arch", "D", false, "Build for both arches seperately and upload twice to the server")
-}
-func compress(outputPath string, inputPath string) {
-	cmd := exec.Command("tar", "-czf", outputPath, "-C/tmp/fermenter", inputPath)
-	cmd.Dir = "/tmp"
-	cmd.Env = []string{"GZIP=-9", "GZIP_OPT=-9"}
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		color.Red("ERROR - COMPRESS: %s", err)
-		os.Exit(1)
-	}
+	buildCmd.Flags().BoolP("universal", "U", false, "Build for both arches and merge them into a single universal upload")
+	buildCmd.Flags().Bool("allow-arch-mismatch", false, "Warn instead of failing when a built binary does not match the target arch")
+	buildCmd.Flags().Bool("strict-libs", false, "Fail when a built binary needs a library that no declared dependency provides")
+	buildCmd.Flags().Bool("rewrite-paths", false, "Replace build paths left in text files of the package with the install prefix")
+	buildCmd.Flags().Bool("strict-paths", false, "Fail when build paths are left in the package after --rewrite-paths")
+	buildCmd.Flags().String("chunk-size", defaultChunkSize, "Size of the parts the archive is uploaded in, e.g. 8M")
+	buildCmd.Flags().String("sign-key", "", "Private key from fermenter keygen to sign the archive with, the signature is uploaded next to it")
+	buildCmd.Flags().Bool("no-cache", false, "Always rebuild instead of reusing a cached archive")
+	buildCmd.Flags().String("cache-dir", defaultCacheDir(), "Directory holding cached archives")
+	buildCmd.Flags().String("cache-url", "", "HTTP cache directory to look up and store archives in")
+	buildCmd.Flags().Bool("all", false, "Build every package in the barrells directory")
+	buildCmd.Flags().String("changed-since", "", "Build the packages whose barrell changed since a git ref of the barrells repo")
+	buildCmd.Flags().IntP("jobs", "j", 1, "Number of packages to build in parallel")
+	buildCmd.Flags().String("rdeps", "", "Rebuild a package and every package depending on it")
+	buildCmd.Flags().String("status-file", "", "File the build status is written to")
+	buildCmd.Flags().MarkHidden("status-file")
+	buildCmd.Flags().String("from", "", fmt.Sprintf("Start at this phase (%s)", strings.Join(phaseNames(), ", ")))
+	buildCmd.Flags().String("to", "", "Stop after this phase")
+	buildCmd.Flags().String("only", "", "Only run this phase")
+	buildCmd.Flags().String("report", "", "Write a JSON build report to this file")
+	addDependencySourceFlags(buildCmd)
+	buildCmd.Flags().String("max-memory", "", "Memory limit for the build and its children, e.g. 4G (linux cgroup v2 only)")
+	buildCmd.Flags().Float64("max-cpus", 0, "Number of CPUs the build may use (linux cgroup v2 only)")
+	buildCmd.Flags().Int64("max-pids", 0, "Maximum number of processes the build may run at once (linux cgroup v2 only)")
+	buildCmd.Flags().String("compiler-cache", "", "Run compilers through ccache or sccache, auto picks whichever is installed")
+	buildCmd.Flags().Lookup("compiler-cache").NoOptDefVal = "auto"
+	buildCmd.Flags().Bool("debug-on-failure", false, "Open a shell in the package workspace when the build fails")
+	buildCmd.Flags().Bool("hermetic", false, "Build and install without network access, barrells that need it must set network = True (linux only)")
 }
 func isDir(path string) (bool, error) {
 	fi, err := os.Stat(path)
@@ -170,7 +242,7 @@ func getFileContent(file string) ([]byte, error) {
 	}
 	return content, nil
 }
-func runBuildCommand(path string, pkg string, arch string) {
+func runBuildCommand(path string, pkg string, arch string) (processUsage, error) {
 	cfg := yacspin.Config{
 		Frequency:         100 * time.Millisecond,
 		CharSet:           yacspin.CharSets[14],
@@ -191,11 +263,35 @@ func runBuildCommand(path string, pkg string, arch string) {
 	}
 	spinner.Start()
 	spinner.Message("Building")
-	if !build(pkg, path, arch) {
+	usage, err := build(pkg, path, arch)
+	if err != nil {
 		spinner.StopFail()
-		os.Exit(1)
+		return usage, err
 	}
 	spinner.Stop()
+	return usage, nil
+}
+
+// workspaceDir returns the directory pkg is downloaded and built in
+func workspaceDir(pkg string) string {
+	return fmt.Sprintf("%s/%s", workspaceRoot, pkg)
+}
+
+// archivePath returns where the compressed prebuild of pkg for arch is written, an empty arch is universal
+func archivePath(pkg string, arch string) string {
+	if arch != "" {
+		return fmt.Sprintf("/tmp/%s-%s.tar.gz", pkg, arch)
+	}
+	return fmt.Sprintf("/tmp/%s.tar.gz", pkg)
+}
+
+// buildEnvironment returns the environment the barrell build runs with
+func buildEnvironment() []string {
+	env := os.Environ()
+	if activeCompilerCache != nil {
+		return activeCompilerCache.environment(env)
+	}
+	return env
 }
 func doesExist(file string) bool {
 	if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -203,50 +299,79 @@ func doesExist(file string) bool {
 	}
 	return true
 }
-func build(pkg string, path string, arch string) bool {
-	if arch == "" {
-		arch = "universal"
-	}
+
+// buildLogPath returns the file the output of the last build of pkg is written to
+func buildLogPath(pkg string) string {
+	return filepath.Join(workspaceRoot, fmt.Sprintf(".%s-build.log", pkg))
+}
+
+// build runs pkg.build() from the barrell at path and returns the resource usage of the build
+// Output goes to the build log of pkg and is appended to /tmp/fermenter.log
+func build(pkg string, path string, arch string) (processUsage, error) {
+	var usage processUsage
 	content, err := getFileContent(path)
 	if err != nil {
-		return false
+		return usage, err
 	}
+	f, err := os.OpenFile("/tmp/fermenter.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return usage, err
+	}
+	defer f.Close()
+	buildLog, err := os.Create(buildLogPath(pkg))
+	if err != nil {
+		return usage, err
+	}
+	defer buildLog.Close()
 	cmd := exec.Command("python3")
 	closer, err := cmd.StdinPipe()
 	if err != nil {
-		return false
+		return usage, err
 	}
 	defer closer.Close()
-	r, w, _ := os.Pipe()
-	cmd.Stdout = w
-	cmd.Stderr = w
+	out := io.MultiWriter(f, buildLog)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = buildEnvironment()
 	cmd.Dir = path[:len(path)-len(pkg)-3]
-	defer r.Close()
-	defer w.Close()
+	if isolatedNetwork {
+		if err := isolateNetwork(cmd); err != nil {
+			return usage, err
+		}
+	}
 	err = cmd.Start()
 	if err != nil {
-		os.WriteFile(fmt.Sprintf("/tmp/fermenter/%s/build.log", pkg), content, 0644)
-		return false
+		os.WriteFile(fmt.Sprintf("%s/build.log", workspaceDir(pkg)), content, 0644)
+		return usage, err
+	}
+	//the build is moved into its cgroup before it is given anything to run
+	release, err := limitBuild(pkg, cmd.Process.Pid)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return usage, err
+	}
+	if isolatedNetwork {
+		io.WriteString(closer, networkPreamble(true))
 	}
 	closer.Write(content)
-	closer.Write([]byte("\n"))
-	io.WriteString(closer, fmt.Sprintf("pkg=%s()\n", convertToReadableString(strings.ToLower(pkg))))
-	io.WriteString(closer, fmt.Sprintf(`pkg.cwd="/tmp/fermenter/%s"`, pkg)+"\n")
-	io.WriteString(closer, fmt.Sprintf(`pkg.arch="%s"`, arch)+"\n")
-	io.WriteString(closer, "pkg.build()\n")
+	io.WriteString(closer, buildInvocation(pkg, arch))
 	closer.Close()
-	w.Close()
-	cmd.Wait()
-	f, err := os.OpenFile("/tmp/fermenter.log", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return false
+	err = cmd.Wait()
+	usage = processUsageOf(cmd.ProcessState)
+	usage.Limit = release(err != nil)
+	if usage.Limit != "" {
+		return usage, fmt.Errorf("%s: build was stopped by its resource limits, see %s", usage.Limit, buildLogPath(pkg))
+	}
+	if err != nil && isolatedNetwork {
+		if line, command, ok := findNetworkFailure(buildLogPath(pkg)); ok {
+			return usage, networkFailureError(line, command)
+		}
 	}
-	_, err = io.Copy(f, r)
 	if err != nil {
-		os.WriteFile("/tmp/fermenter.log", []byte(err.Error()), 0644)
-		return false
+		return usage, fmt.Errorf("build exited with status %d, see %s", usage.ExitCode, buildLogPath(pkg))
 	}
-	return true
+	return usage, nil
 }
 func downloadsource(pkg string, path string) bool {
 	path = path + "/" + pkg + ".py"
@@ -328,7 +453,7 @@ func Untar(dst string, downloadedFile string, pkg string) error {
 
 }
 func DownloadFromGithub(url string, pkg string) error {
-	_, err := git.PlainClone(fmt.Sprintf("/tmp/fermenter/%s", pkg), false, &git.CloneOptions{
+	_, err := git.PlainClone(workspaceDir(pkg), false, &git.CloneOptions{
 		URL: url,
 	})
 	if err != nil {
@@ -421,12 +546,12 @@ func DownloadFromTar(pkg string, url string) string {
 		panic(err)
 	}
 	io.Copy(file, resp.Body)
-	err = Untar("/tmp/fermenter/", fmt.Sprintf("/tmp/%s", fileName), convertToReadableString(strings.ToLower(pkg)))
+	err = Untar(workspaceRoot+"/", fmt.Sprintf("/tmp/%s", fileName), convertToReadableString(strings.ToLower(pkg)))
 	if err != nil {
 		fmt.Println(color.RedString("Unable to extract %s", pkg))
 		panic(err)
 	}
-	return fmt.Sprintf("/tmp/fermenter/%s", pkg)
+	return workspaceDir(pkg)
 }
 func GetDownloadUrl(pkg string, path string) string {
 	content, err := getFileContent(path)
@@ -468,7 +593,14 @@ func GetDownloadUrl(pkg string, path string) string {
 	return path
 }
 
-func getDependencies(path string, pkg string) []string {
+// getDependencies returns the runtime dependencies of the barrell at path
+func getDependencies(path string, pkg string) ([]string, error) {
+	return getDependencySet(path, pkg, runtimeDependencies)
+}
+
+// getDependencySet returns the dependency specs in the attr list of the barrell at path
+// A barrell without the attribute has none, a barrell that fails to load is an error
+func getDependencySet(path string, pkg string, attr string) ([]string, error) {
 	content, err := getFileContent(path)
 	if err != nil {
 		panic(err)
@@ -490,10 +622,10 @@ func getDependencies(path string, pkg string) []string {
 	closer.Write(content)
 	closer.Write([]byte("\n"))
 	io.WriteString(closer, fmt.Sprintf("pkg=%s()\n", convertToReadableString(strings.ToLower(pkg))))
-	io.WriteString(closer, "print(pkg.dependencies)\n")
+	io.WriteString(closer, fmt.Sprintf("print(getattr(pkg, '%s', []))\n", attr))
 	closer.Close()
 	w.Close()
-	cmd.Wait()
+	waitErr := cmd.Wait()
 	var buf bytes.Buffer
 	io.Copy(&buf, r)
 	c := strings.Replace(buf.String(), " ", "", -1)
@@ -502,51 +634,70 @@ func getDependencies(path string, pkg string) []string {
 	c = strings.Replace(c, "]", "", -1)
 	c = strings.Replace(c, "\"", "", -1)
 	c = strings.Replace(c, "'", "", -1)
-	if strings.Contains(buf.String(), "AttributeError") {
-		return []string{}
+	if waitErr != nil {
+		//the last line of a traceback names the exception
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		return nil, fmt.Errorf("reading %s of %s: %s", attr, pkg, lines[len(lines)-1])
+	}
+	if c == "" {
+		return []string{}, nil
 	}
-	return strings.Split(c, ",")
+	return strings.Split(c, ","), nil
+}
+
+// dependencyPackage returns the package name of a dependency spec such as package, command:package or package>=1.0
+func dependencyPackage(dep string) string {
+	return parseDepSpec(dep).Package
 }
-func installDependencies(dependencies []string, path string, barrellsLoc string) {
+
+// installDependencies installs the dependencies that are missing or do not meet their version constraint
+// probes are the probe declarations of the barrells by dependency, see probesFor
+func installDependencies(dependencies []string, probes map[string][]string, barrellsLoc string, source dependencySource) error {
 	fmt.Println(color.GreenString("Installing dependencies"))
-	//check if already installed by using which command
-	if len(dependencies) == 0 {
-		return
-	}
 	for _, dependency := range dependencies {
-		//check if you can split dep by :
-		var command = dependency
-		if strings.Contains(dependency, ":") {
-			command = strings.Split(dependency, ":")[0]
-			dependency = strings.Split(dependency, ":")[1]
-
-		}
-		color.Yellow("Installing %s as dependency", dependency)
-		cmd := exec.Command("which", strings.ReplaceAll(command, "'", ""))
-		err := cmd.Run()
-		if err == nil {
-			color.Yellow("%s already installed", dependency)
+		d := parseDepSpec(dependency)
+		if d.Package == "" {
 			continue
 		}
-		if IsLib(dependency, barrellsLoc) && checkIfPackageExists(dependency) {
-			color.Yellow("%s is a lib and already installed", dependency)
-			continue
+		depProbes, err := probesFor(d, probes[d.Package])
+		if err != nil {
+			return err
 		}
-		_, err = os.Stat(fmt.Sprintf("%s/%s.py", barrellsLoc, convertToReadableString(strings.ToLower(dependency))))
-		if os.IsNotExist(err) {
-			color.Yellow("%s is not downloadable by ferment, skipping...", dependency)
+		installed, ok := runProbes(depProbes)
+		if ok && d.satisfiedBy(installed) {
+			color.Yellow("%s already installed", d.Package)
 			continue
 		}
-		fmt.Printf(color.YellowString("Now Installing %s\n"), dependency)
-		cmd = exec.Command("ferment", "install", dependency)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stderr
-		cmd.Stdin = os.Stdin
-		err = cmd.Run()
+		if !doesExist(barrellPath(d.Package, barrellsLoc)) {
+			if d.Op == "" {
+				color.Yellow("%s is not downloadable by ferment, skipping...", d.Package)
+				continue
+			}
+			return unsatisfiedError(d, installed, "")
+		}
+		provided, err := getBarrellAttribute(d.Package, "version", barrellsLoc)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if provided != "" && !d.satisfiedBy(provided) {
+			return unsatisfiedError(d, installed, provided)
+		}
+		upgrade := checkIfPackageExists(d.Package)
+		if upgrade {
+			color.Yellow("Upgrading %s from %s to meet %s", d.Package, installed, d)
+		} else {
+			fmt.Printf(color.YellowString("Now Installing %s\n"), d.Package)
+		}
+		if err := source.install(d.Package, upgrade, barrellsLoc); err != nil {
+			return err
+		}
+		if d.Op != "" {
+			if installed, _ = runProbes(depProbes); !d.satisfiedBy(installed) {
+				return unsatisfiedError(d, installed, provided)
+			}
 		}
 	}
+	return nil
 }
 func IsLib(pkg string, location string) bool {
 	content, err := os.ReadFile(fmt.Sprintf("%s/%s.py", location, convertToReadableString(strings.ToLower(pkg))))
@@ -580,7 +731,9 @@ func IsLib(pkg string, location string) bool {
 	}
 
 }
-func uploadtoapi(pkg string, arch string) {
+
+// uploadtoapi uploads archive in parts of chunkSize bytes and returns the uploaded file name and the number of parts
+func uploadtoapi(archive string, pkg string, arch string, chunkSize int64) (string, int) {
 
 	f, _ := os.OpenFile("/tmp/fermenter.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	l := log.New(f, "UPLOAD: ", log.Ltime)
@@ -604,7 +757,6 @@ func uploadtoapi(pkg string, arch string) {
 	}
 	spinner.Start()
 	spinner.Message("Initializing...")
-	compress(fmt.Sprintf("/tmp/%s.tar.gz", pkg), pkg)
 	u := url.URL{Scheme: "wss", Host: "upload.fermentpkg.tech"}
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
@@ -646,31 +798,23 @@ func uploadtoapi(pkg string, arch string) {
 			}
 		}
 	}()
-	split(fmt.Sprintf("/tmp/%s.tar.gz", pkg))
-	if err != nil {
-		spinner.StopFailMessage("Failed Line:699 - " + err.Error())
-		spinner.StopFail()
-	}
-
 	type Data struct {
-		File string `json:"file"`
-		Part int    `json:"part"`
-		Name string `json:"name"`
-		Of   int    `json:"of"`
-		Data string `json:"data"`
+		File   string `json:"file"`
+		Part   int    `json:"part"`
+		Name   string `json:"name"`
+		Of     int    `json:"of"`
+		Data   string `json:"data"`
+		SHA256 string `json:"sha256"`
 	}
 	var data Data
-	stat, err := os.Stat(fmt.Sprintf("/tmp/%s.tar.gz", pkg))
+	parts, err := newChunker(archive, chunkSize)
 	if err != nil {
 		spinner.StopFailMessage("Failed - " + err.Error())
 		spinner.StopFail()
 		os.Exit(1)
 	}
-	megabytes := math.Round((float64)(stat.Size() / 1e6))
-	data.Of = int(megabytes / 90)
-	if data.Of == 0 {
-		data.Of++
-	}
+	defer parts.Close()
+	data.Of = parts.parts
 	data.Name = pkg
 	version, err := executeQuickPython(fmt.Sprintf("import %s;pkg=%s.%s();print(pkg.version)", pkg, pkg, pkg), barrellsloc)
 	if err != nil {
@@ -684,32 +828,20 @@ func uploadtoapi(pkg string, arch string) {
 		data.File = fmt.Sprintf("%s@%s.tar.gz", pkg, strings.Replace(version, "\n", "", -1))
 	}
 
-	data.Part = 1
-	for i := 1; i <= data.Of; i++ {
-		spinner.Message(fmt.Sprintf("Uploading Part %d of %d... (%fmb)", i, data.Of, megabytes))
-		data.Part = i
-		//list all files in /tmp
-		files, err := os.ReadDir("/tmp")
-		if err != nil {
-			spinner.StopFailMessage("Failed - " + err.Error())
-			spinner.StopFail()
-			os.Exit(1)
-		}
-		var f string
-		for _, fi := range files {
-			if strings.Contains(fi.Name(), "tar.gz") && strings.Contains(fi.Name(), fmt.Sprintf("%d", i-1)) && strings.Contains(fi.Name(), pkg) {
-				f = fi.Name()
-				break
-			}
+	for {
+		part, err := parts.next()
+		if err == io.EOF {
+			break
 		}
-		content, err := os.ReadFile(fmt.Sprintf("/tmp/%s", f))
 		if err != nil {
 			spinner.StopFailMessage("Failed - " + err.Error())
 			spinner.StopFail()
 			os.Exit(1)
 		}
-		encoded := base64Encode(content)
-		data.Data = encoded
+		spinner.Message(fmt.Sprintf("Uploading Part %d of %d... (%.1fmb)", part.Part, part.Of, float64(len(part.Data))/1e6))
+		data.Part = part.Part
+		data.Data = base64Encode(part.Data)
+		data.SHA256 = part.SHA256
 		en, err := json.Marshal(data)
 		if err != nil {
 			spinner.StopFailMessage("Failed - " + err.Error())
@@ -730,70 +862,54 @@ func uploadtoapi(pkg string, arch string) {
 		for !r {
 			r = <-replied
 		}
-		spinner.Message(fmt.Sprintf("Uploaded Part %d of %d", i, data.Of))
-		os.WriteFile("test.json", en, 0644)
-
+		spinner.Message(fmt.Sprintf("Uploaded Part %d of %d", part.Part, part.Of))
+	}
+	if signature, err := os.ReadFile(archive + signatureSuffix); err == nil {
+		spinner.Message("Uploading Signature")
+		sum := sha256.Sum256(signature)
+		sig := Data{File: data.File + signatureSuffix, Part: 1, Of: 1, Name: pkg, Data: base64Encode(signature), SHA256: hex.EncodeToString(sum[:])}
+		en, err := json.Marshal(sig)
+		if err != nil {
+			spinner.StopFailMessage("Failed - " + err.Error())
+			spinner.StopFail()
+			os.Exit(1)
+		}
+		if err := c.WriteMessage(websocket.TextMessage, en); err != nil {
+			spinner.StopFailMessage("Failed - " + err.Error())
+			spinner.StopFail()
+			os.Exit(1)
+		}
+		r := <-replied
+		for !r {
+			r = <-replied
+		}
 	}
 	spinner.Message("Uploading Complete")
 	spinner.Stop()
 	done <- true
-
+	return data.File, data.Of
 }
 func checkIfPackageExists(pkg string) bool {
 	pkg = convertToReadableString(strings.ToLower(pkg))
-	_, err := os.ReadDir(fmt.Sprintf("/usr/local/ferment/Installed/%s", pkg))
+	_, err := os.ReadDir(filepath.Join(installedDir(), pkg))
 	return err == nil
 }
 func base64Encode(str []byte) string {
 	return base64.StdEncoding.EncodeToString(str)
 }
+func executeQuickPython(code string, barrellsLoc string) (string, error) {
+	return runQuickPython(pythonCommand("-c", code), barrellsLoc)
+}
 
-// Split a file into smaller chunks
-// Splits every 90mb to allow for uploads of more than 90mb
-// Helps bypass cloudflare limit
-func split(fileToBeChunked string) {
-	file, err := os.Open(fileToBeChunked)
-
+// executeIsolatedPython is executeQuickPython without network access
+func executeIsolatedPython(code string, barrellsLoc string) (string, error) {
+	cmd, err := isolatedPythonCommand(code)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	defer file.Close()
-
-	fileInfo, _ := file.Stat()
-
-	var fileSize int64 = fileInfo.Size()
-
-	const fileChunk = 1e7 * 2 // 20 MB
-
-	// calculate total number of parts the file will be chunked into
-
-	totalPartsNum := uint64(math.Ceil(float64(fileSize) / float64(fileChunk)))
-
-	for i := uint64(0); i < totalPartsNum; i++ {
-
-		partSize := int(math.Min(fileChunk, float64(fileSize-int64(i*fileChunk))))
-		partBuffer := make([]byte, partSize)
-
-		file.Read(partBuffer)
-
-		// write to disk
-		fileName := fileToBeChunked + ".part" + strconv.FormatUint(i, 10)
-		_, err := os.Create(fileName)
-
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		// write/save buffer to disk
-		os.WriteFile(fileName, partBuffer, os.ModeAppend)
-
+		return "", err
 	}
+	return runQuickPython(cmd, barrellsLoc)
 }
-func executeQuickPython(code string, barrellsLoc string) (string, error) {
-	cmd := exec.Command("sudo", "python3", "-c", code)
+func runQuickPython(cmd *exec.Cmd, barrellsLoc string) (string, error) {
 	cmd.Dir = barrellsLoc
 	var out bytes.Buffer
 	var errPipe bytes.Buffer
@@ -807,6 +923,15 @@ func executeQuickPython(code string, barrellsLoc string) (string, error) {
 
 }
 
+// getBarrellAttribute returns the value of attr on the barrell of pkg, or an empty string when it is not set
+func getBarrellAttribute(pkg string, attr string, barrellsLoc string) (string, error) {
+	out, err := executeQuickPython(fmt.Sprintf("from %s import %s;pkg=%s();print(getattr(pkg,'%s',''))", pkg, pkg, pkg, attr), barrellsLoc)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
 func keepAlive(c *websocket.Conn, timeout time.Duration) {
 	lastResponse := time.Now()
 	c.SetPongHandler(func(msg string) error {
@@ -839,11 +964,13 @@ func magicWatcher(pkg string, done chan bool) {
 	watch := watcher.New()
 	dirsWatched := []string{"bin", "share", "include", "lib"}
 	for _, dir := range dirsWatched {
-		watch.Add(fmt.Sprintf("/usr/local/%s", dir))
+		//the watcher can only add existing directories, a fresh prefix has none yet
+		os.MkdirAll(prefixPath(dir), 0755)
+		watch.Add(prefixPath(dir))
 	}
-	watch.Add("/usr/local")
+	watch.Add(fermentPrefix())
 	go watch.Start(10 * time.Millisecond)
-	watcherfile, err := os.OpenFile("/tmp/fermenter/"+pkg+"/.ferment-watcher", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0777)
+	watcherfile, err := os.OpenFile(workspaceDir(pkg)+"/.ferment-watcher", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0777)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,255 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/spf13/cobra"
+)
+
+// cacheEnvVars are the variables from the build environment that change the build output
+var cacheEnvVars = []string{"CC", "CXX", "CFLAGS", "CXXFLAGS", "CPPFLAGS", "LDFLAGS", "PKG_CONFIG_PATH", "MACOSX_DEPLOYMENT_TARGET", "SOURCE_DATE_EPOCH"}
+
+// buildCache stores prebuild archives keyed by everything that goes into a build
+// Archives are looked up in dir first, then under url if one is configured
+type buildCache struct {
+	dir string
+	url string
+	log *log.Logger
+}
+
+// newBuildCache returns the cache configured by the flags of cmd, or nil when --no-cache is set
+func newBuildCache(cmd *cobra.Command) *buildCache {
+	noCache, err := cmd.Flags().GetBool("no-cache")
+	if err != nil {
+		panic(err)
+	}
+	if noCache {
+		return nil
+	}
+	dir, err := cmd.Flags().GetString("cache-dir")
+	if err != nil {
+		panic(err)
+	}
+	cacheURL, err := cmd.Flags().GetString("cache-url")
+	if err != nil {
+		panic(err)
+	}
+	f, _ := os.OpenFile("/tmp/fermenter.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	return &buildCache{
+		dir: dir,
+		url: strings.TrimSuffix(cacheURL, "/"),
+		log: log.New(f, "CACHE: ", log.Ltime),
+	}
+}
+
+// defaultCacheDir returns the user cache directory for fermenter
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "fermenter-cache")
+	}
+	return filepath.Join(dir, "fermenter")
+}
+
+// fetch copies the archive for key to dst and reports whether it was found
+func (c *buildCache) fetch(key string, dst string) bool {
+	local := filepath.Join(c.dir, key+".tar.gz")
+	if doesExist(local) {
+		if err := copyFile(local, dst, 0644); err == nil {
+			c.log.Printf("hit %s (local)", key)
+			return true
+		}
+	}
+	if c.url == "" {
+		return false
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/%s.tar.gz", c.url, key))
+	if err != nil {
+		c.log.Printf("remote lookup failed for %s: %s", key, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		c.log.Printf("remote download failed for %s: %s", key, err)
+		return false
+	}
+	c.log.Printf("hit %s (remote)", key)
+	//keep a local copy so the next lookup does not hit the network
+	c.storeLocal(key, dst)
+	return true
+}
+
+// store saves the archive at src under key, locally and on the remote cache if configured
+func (c *buildCache) store(key string, src string) {
+	c.storeLocal(key, src)
+	if c.url == "" {
+		return
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%s.tar.gz", c.url, key), bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.log.Printf("remote store failed for %s: %s", key, err)
+		return
+	}
+	resp.Body.Close()
+	c.log.Printf("stored %s (remote, %s)", key, resp.Status)
+}
+func (c *buildCache) storeLocal(key string, src string) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		c.log.Printf("unable to create %s: %s", c.dir, err)
+		return
+	}
+	if err := copyFile(src, filepath.Join(c.dir, key+".tar.gz"), 0644); err != nil {
+		c.log.Printf("local store failed for %s: %s", key, err)
+		return
+	}
+	c.log.Printf("stored %s (local)", key)
+}
+
+// cacheKey hashes the barrell, its source, the target arch, the build environment, the package checks and dependency versions
+// Dependencies without a barrell are hashed with the version their probes find installed
+func cacheKey(path string, pkg string, opts buildOptions, arch string) (string, error) {
+	content, err := getFileContent(path)
+	if err != nil {
+		return "", err
+	}
+	source, err := sourceIdentity(pkg, opts.Barrells)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	lines = append(lines, "fermenter-cache v1")
+	lines = append(lines, fmt.Sprintf("barrell %x", sha256.Sum256(content)))
+	lines = append(lines, "source "+source)
+	lines = append(lines, "arch "+arch)
+	lines = append(lines, "os "+runtime.GOOS)
+	lines = append(lines, "prefix "+fermentPrefix())
+	//the checks change the archive or decide whether it is accepted, a hit skips them
+	lines = append(lines, fmt.Sprintf("checks rewrite-paths=%t strict-paths=%t strict-libs=%t allow-arch-mismatch=%t",
+		opts.RewritePaths, opts.StrictPaths, opts.StrictLibs, opts.AllowArchMismatch))
+	for _, kv := range buildEnvironment() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if containsString(cacheEnvVars, name) {
+			lines = append(lines, "env "+kv)
+		}
+	}
+	probes, err := getBarrellProbes(pkg, opts.Barrells)
+	if err != nil {
+		return "", err
+	}
+	specs, err := dependenciesFor(path, pkg, buildSets...)
+	if err != nil {
+		return "", err
+	}
+	var deps []string
+	for _, spec := range specs {
+		d := parseDepSpec(spec)
+		dep := d.Package
+		if dep == "" {
+			continue
+		}
+		var version string
+		if doesExist(fmt.Sprintf("%s/%s.py", opts.Barrells, dep)) {
+			version, err = getBarrellAttribute(dep, "version", opts.Barrells)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			checks, err := probesFor(d, probes[dep])
+			if err != nil {
+				return "", err
+			}
+			installed, found := runProbes(checks)
+			switch {
+			case !found:
+				version = "system missing"
+			case installed == "":
+				version = "system unknown"
+			default:
+				version = "system " + installed
+			}
+		}
+		deps = append(deps, fmt.Sprintf("dep %s=%s", dep, version))
+	}
+	sort.Strings(deps)
+	lines = append(lines, deps...)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sourceIdentity returns the commit HEAD points to for git sources, or the url and declared checksum for tarballs
+func sourceIdentity(pkg string, barrellsLoc string) (string, error) {
+	path := fmt.Sprintf("%s/%s.py", barrellsLoc, pkg)
+	if UsingGit(pkg, path) {
+		url := strings.TrimSpace(GetGitURL(pkg, path))
+		commit, err := remoteHead(url)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("git %s %s", url, commit), nil
+	}
+	url, err := getBarrellAttribute(pkg, "url", barrellsLoc)
+	if err != nil {
+		return "", err
+	}
+	sum, err := getBarrellAttribute(pkg, "sha256", barrellsLoc)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("url %s %s", url, sum), nil
+}
+
+// remoteHead resolves the commit HEAD points to on a remote without cloning it
+func remoteHead(url string) (string, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	resolved := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, ref := range refs {
+		resolved[ref.Name()] = ref
+	}
+	head, ok := resolved[plumbing.HEAD]
+	for i := 0; ok && head.Type() == plumbing.SymbolicReference && i < 10; i++ {
+		head, ok = resolved[head.Target()]
+	}
+	if !ok || head.Type() != plumbing.HashReference {
+		return "", fmt.Errorf("unable to resolve HEAD of %s", url)
+	}
+	return head.Hash().String(), nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupRoot is the cgroup v2 mount point
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupParent holds the transient groups of builds, it lives directly below the root
+// so controllers can be enabled without running into the no internal processes rule
+var cgroupParent = filepath.Join(cgroupRoot, "fermenter")
+
+// buildCgroup is a transient cgroup v2 group a build and its children run in
+type buildCgroup struct {
+	path string
+}
+
+func newBuildCgroup(name string, limits resourceLimits) (*buildCgroup, error) {
+	if !doesExist(filepath.Join(cgroupRoot, "cgroup.controllers")) {
+		return nil, errors.New("cgroup v2 is not mounted at " + cgroupRoot)
+	}
+	controllers := []string{"+memory", "+pids", "+cpu"}
+	for _, dir := range []string{cgroupRoot, cgroupParent} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		for _, controller := range controllers {
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", controller); err != nil {
+				return nil, fmt.Errorf("enabling %s controller in %s: %s", controller[1:], dir, err)
+			}
+		}
+	}
+	cg := &buildCgroup{path: filepath.Join(cgroupParent, name)}
+	if err := os.Mkdir(cg.path, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if limits.MemoryBytes > 0 {
+		err = writeCgroupFile(cg.path, "memory.max", strconv.FormatInt(limits.MemoryBytes, 10))
+		//swapping instead of failing is what takes the machine down
+		if err == nil && doesExist(filepath.Join(cg.path, "memory.swap.max")) {
+			err = writeCgroupFile(cg.path, "memory.swap.max", "0")
+		}
+		if err == nil {
+			err = writeCgroupFile(cg.path, "memory.oom.group", "1")
+		}
+	}
+	if err == nil && limits.CPUs > 0 {
+		const period = 100000
+		err = writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%d %d", int64(limits.CPUs*period), period))
+	}
+	if err == nil && limits.Pids > 0 {
+		err = writeCgroupFile(cg.path, "pids.max", strconv.FormatInt(limits.Pids, 10))
+	}
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+func writeCgroupFile(dir string, name string, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+// add moves pid into the group, children it starts afterwards inherit the group
+func (c *buildCgroup) add(pid int) error {
+	return writeCgroupFile(c.path, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// limitHit returns the category of the limit that stopped the build, or an empty string
+func (c *buildCgroup) limitHit() string {
+	if cgroupEvent(c.path, "memory.events", "oom_kill") > 0 {
+		return "out of memory"
+	}
+	if cgroupEvent(c.path, "pids.events", "max") > 0 {
+		return "pid limit"
+	}
+	return ""
+}
+func cgroupEvent(dir string, file string, key string) int64 {
+	f, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// remove kills anything left in the group and deletes it
+func (c *buildCgroup) remove() {
+	writeCgroupFile(c.path, "cgroup.kill", "1")
+	for i := 0; i < 50; i++ {
+		if err := os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import "errors"
+
+// buildCgroup is unavailable outside of linux
+type buildCgroup struct{}
+
+func newBuildCgroup(name string, limits resourceLimits) (*buildCgroup, error) {
+	return nil, errors.New("resource limits need cgroup v2, which is only available on linux")
+}
+func (c *buildCgroup) add(pid int) error {
+	return nil
+}
+func (c *buildCgroup) limitHit() string {
+	return ""
+}
+func (c *buildCgroup) remove() {}
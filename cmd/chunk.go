@@ -0,0 +1,83 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultChunkSize is the size of an upload part unless --chunk-size is given, 20 MB as uploads always used
+const defaultChunkSize = "20000000"
+
+// chunk is one part of an archive being uploaded, Part counts from 1
+type chunk struct {
+	Part   int
+	Of     int
+	Data   []byte
+	SHA256 string
+}
+
+// chunker reads an archive part by part into a single reused buffer
+// Data of a chunk is only valid until the next call to next
+type chunker struct {
+	f     *os.File
+	parts int
+	part  int
+	buf   []byte
+}
+
+// newChunker opens path for reading in parts of chunkSize bytes
+// An empty file is a single empty part so the server still receives it
+func newChunker(path string, chunkSize int64) (*chunker, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	parts := int((stat.Size() + chunkSize - 1) / chunkSize)
+	if parts == 0 {
+		parts = 1
+	}
+	bufSize := chunkSize
+	if stat.Size() < bufSize {
+		bufSize = stat.Size()
+	}
+	return &chunker{f: f, parts: parts, buf: make([]byte, bufSize)}, nil
+}
+
+// next returns the next part, or io.EOF once every part was read
+// Fails when the file ends before the expected number of parts was read
+func (c *chunker) next() (chunk, error) {
+	if c.part == c.parts {
+		return chunk{}, io.EOF
+	}
+	n, err := io.ReadFull(c.f, c.buf)
+	if err == io.ErrUnexpectedEOF && c.part+1 == c.parts {
+		//only the last part may be shorter than the chunk size
+		err = nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return chunk{}, fmt.Errorf("%s changed while uploading, part %d of %d is short", c.f.Name(), c.part+1, c.parts)
+	}
+	if err != nil {
+		return chunk{}, err
+	}
+	c.part++
+	sum := sha256.Sum256(c.buf[:n])
+	return chunk{Part: c.part, Of: c.parts, Data: c.buf[:n], SHA256: hex.EncodeToString(sum[:])}, nil
+}
+func (c *chunker) Close() error {
+	return c.f.Close()
+}
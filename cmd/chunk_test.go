@@ -0,0 +1,104 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunker(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int64
+		parts     []int
+	}{
+		{"empty file", 0, 10, []int{0}},
+		{"smaller than a chunk", 3, 10, []int{3}},
+		{"exactly one chunk", 10, 10, []int{10}},
+		{"one byte over", 11, 10, []int{10, 1}},
+		{"several chunks", 25, 10, []int{10, 10, 5}},
+		{"exact multiple", 30, 10, []int{10, 10, 10}},
+		{"chunk of one byte", 3, 1, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			path := filepath.Join(t.TempDir(), "archive.tar.gz")
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := newChunker(path, tt.chunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			var got []byte
+			for i, want := range tt.parts {
+				part, err := c.next()
+				if err != nil {
+					t.Fatalf("part %d: %s", i+1, err)
+				}
+				if part.Part != i+1 || part.Of != len(tt.parts) {
+					t.Fatalf("got part %d of %d, want %d of %d", part.Part, part.Of, i+1, len(tt.parts))
+				}
+				if len(part.Data) != want {
+					t.Fatalf("part %d has %d bytes, want %d", i+1, len(part.Data), want)
+				}
+				sum := sha256.Sum256(part.Data)
+				if part.SHA256 != hex.EncodeToString(sum[:]) {
+					t.Fatalf("part %d has the wrong sha256", i+1)
+				}
+				got = append(got, part.Data...)
+			}
+			if _, err := c.next(); err != io.EOF {
+				t.Fatalf("after the last part got %v, want io.EOF", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatal("parts do not add up to the file")
+			}
+		})
+	}
+}
+
+func TestChunkerShortRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := os.WriteFile(path, make([]byte, 25), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newChunker(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//the archive shrinks after the parts were counted
+	if err := os.Truncate(path, 15); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.next(); err != nil {
+		t.Fatalf("first part: %s", err)
+	}
+	if _, err := c.next(); err == nil || !strings.Contains(err.Error(), "changed while uploading") {
+		t.Fatalf("short second part got %v, want a changed while uploading error", err)
+	}
+}
+
+func TestNewChunkerRejectsSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{0, -1} {
+		if _, err := newChunker(path, size); err == nil {
+			t.Fatalf("newChunker with size %d did not fail", size)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// cachedCompilers are wrapped to go through the compiler cache when found on PATH
+var cachedCompilers = []string{"cc", "c++", "gcc", "g++", "clang", "clang++"}
+
+// compilerCache is ccache or sccache wrapping the compilers of a build
+type compilerCache struct {
+	Tool string
+	Dir  string
+	// wrappers holds a script per compiler that runs it through Tool, it is put in front of PATH
+	wrappers string
+}
+
+// activeCompilerCache is used by the barrell build currently running, nil when disabled
+var activeCompilerCache *compilerCache
+
+// newCompilerCache finds the tool named by choice, auto picks ccache and then sccache
+// The cache itself is kept below cacheDir so it persists between builds
+func newCompilerCache(choice string, cacheDir string) (*compilerCache, error) {
+	tools := []string{choice}
+	if choice == "auto" {
+		tools = []string{"ccache", "sccache"}
+	}
+	for _, tool := range tools {
+		if tool != "ccache" && tool != "sccache" {
+			return nil, fmt.Errorf("unknown compiler cache %s, use ccache, sccache or auto", tool)
+		}
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			continue
+		}
+		c := &compilerCache{Tool: path, Dir: filepath.Join(cacheDir, tool)}
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := c.writeWrappers(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("%s not found on PATH", strings.Join(tools, " or "))
+}
+func (c *compilerCache) writeWrappers() error {
+	var err error
+	c.wrappers, err = os.MkdirTemp("", "fermenter-cc-")
+	if err != nil {
+		return err
+	}
+	for _, compiler := range cachedCompilers {
+		real, err := exec.LookPath(compiler)
+		if err != nil {
+			continue
+		}
+		script := fmt.Sprintf("#!/bin/sh\nexec %s %s \"$@\"\n", shellQuote(c.Tool), shellQuote(real))
+		if err := os.WriteFile(filepath.Join(c.wrappers, compiler), []byte(script), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (c *compilerCache) name() string {
+	return filepath.Base(c.Tool)
+}
+
+// environment adds the compiler wrappers and cache location to env
+// CC and CXX are left alone so the archive cache key does not change with the compiler cache
+// CMake finds the wrappers on PATH too, its compiler launchers would run the cache twice
+func (c *compilerCache) environment(env []string) []string {
+	env = withPath(env, c.wrappers)
+	if c.name() == "ccache" {
+		return append(env, "CCACHE_DIR="+c.Dir)
+	}
+	return append(env, "SCCACHE_DIR="+c.Dir, "RUSTC_WRAPPER="+c.Tool)
+}
+
+// compilerCacheStats counts cache hits and misses, a build's rate is the difference before and after it
+type compilerCacheStats struct {
+	Hits   int64
+	Misses int64
+}
+
+func (s compilerCacheStats) since(before compilerCacheStats) compilerCacheStats {
+	return compilerCacheStats{Hits: s.Hits - before.Hits, Misses: s.Misses - before.Misses}
+}
+func (s compilerCacheStats) String() string {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return "no cacheable compilations"
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.1f%% hit rate)", s.Hits, s.Misses, float64(s.Hits)*100/float64(total))
+}
+
+// stats reads the hit and miss counters of the cache
+func (c *compilerCache) stats() (compilerCacheStats, error) {
+	var stats compilerCacheStats
+	if c.name() == "ccache" {
+		cmd := exec.Command(c.Tool, "--print-stats")
+		cmd.Env = c.environment(os.Environ())
+		out, err := cmd.Output()
+		if err != nil {
+			return stats, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			switch fields[0] {
+			case "direct_cache_hit", "preprocessed_cache_hit":
+				stats.Hits += n
+			case "cache_miss":
+				stats.Misses += n
+			}
+		}
+		return stats, nil
+	}
+	cmd := exec.Command(c.Tool, "--show-stats", "--stats-format=json")
+	cmd.Env = c.environment(os.Environ())
+	out, err := cmd.Output()
+	if err != nil {
+		return stats, err
+	}
+	var report struct {
+		Stats struct {
+			CacheHits   struct{ Counts map[string]int64 } `json:"cache_hits"`
+			CacheMisses struct{ Counts map[string]int64 } `json:"cache_misses"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return stats, errors.New("unable to read sccache stats")
+	}
+	for _, n := range report.Stats.CacheHits.Counts {
+		stats.Hits += n
+	}
+	for _, n := range report.Stats.CacheMisses.Counts {
+		stats.Misses += n
+	}
+	return stats, nil
+}
+
+// resolveCompilerCache enables the compiler cache for t unless the barrell sets compiler_cache = False
+func resolveCompilerCache(t *buildTarget) error {
+	activeCompilerCache = nil
+	if t.Options.CompilerCache == "" {
+		return nil
+	}
+	optOut, err := getBarrellAttribute(t.Package, "compiler_cache", t.Options.Barrells)
+	if err != nil {
+		return err
+	}
+	if optOut == "False" {
+		color.Yellow("%s sets compiler_cache = False, building without compiler cache", t.Package)
+		return nil
+	}
+	activeCompilerCache, err = newCompilerCache(t.Options.CompilerCache, t.Options.CacheDir)
+	if err != nil {
+		color.Yellow("WARNING - COMPILER CACHE: %s, building without compiler cache", err)
+	}
+	return nil
+}
+
+// recordCompilerCacheStats prints the hit rate of the build of t and keeps it for the build report
+func recordCompilerCacheStats(t *buildTarget, before compilerCacheStats) {
+	after, err := activeCompilerCache.stats()
+	if err != nil {
+		color.Yellow("WARNING - COMPILER CACHE: unable to read stats: %s", err)
+		return
+	}
+	stats := after.since(before)
+	color.Green("Compiler cache (%s): %s", activeCompilerCache.name(), stats)
+	t.State.Outputs["compilerCache"] = activeCompilerCache.name()
+	t.State.Outputs["compilerCacheHits"] = strconv.FormatInt(stats.Hits, 10)
+	t.State.Outputs["compilerCacheMisses"] = strconv.FormatInt(stats.Misses, 10)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// constraintOps are the version operators of a dependency spec, longest first so >= wins over >
+var constraintOps = []string{">=", "<=", "~=", "==", "!=", ">", "<", "@"}
+
+// depSpec is a dependency written as [command:]package[op version], e.g. openssl>=3.0 or python3:python@3.11
+type depSpec struct {
+	// Command is looked up on PATH to check whether the dependency is installed, it defaults to Package
+	Command string
+	Package string
+	Op      string
+	Version string
+}
+
+func parseDepSpec(spec string) depSpec {
+	spec = strings.TrimSpace(strings.ReplaceAll(spec, "'", ""))
+	var d depSpec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		d.Command = spec[:i]
+		spec = spec[i+1:]
+	}
+	name := spec
+	for _, op := range constraintOps {
+		if i := strings.Index(spec, op); i > 0 {
+			name = spec[:i]
+			d.Op = op
+			d.Version = strings.TrimSpace(spec[i+len(op):])
+			break
+		}
+	}
+	d.Package = convertToReadableString(strings.ToLower(strings.TrimSpace(name)))
+	if d.Command == "" {
+		d.Command = strings.TrimSpace(name)
+	}
+	return d
+}
+func (d depSpec) String() string {
+	return d.Package + d.Op + d.Version
+}
+
+// satisfiedBy reports whether version meets the constraint, a spec without one accepts any version
+func (d depSpec) satisfiedBy(version string) bool {
+	if d.Op == "" {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+	c := compareVersions(version, d.Version)
+	switch d.Op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "@":
+		//python@3.11 accepts 3.11 and 3.11.x
+		return c == 0 || strings.HasPrefix(version, d.Version+".")
+	case "~=":
+		//~=1.2 accepts 1.x from 1.2 on, ~=1.2.3 accepts 1.2.x from 1.2.3 on
+		parts := strings.Split(d.Version, ".")
+		if len(parts) < 2 {
+			return c >= 0
+		}
+		prefix := strings.Join(parts[:len(parts)-1], ".")
+		return c >= 0 && (version == prefix || strings.HasPrefix(version, prefix+"."))
+	}
+	return false
+}
+
+// compareVersions compares dotted versions numerically, missing components count as 0
+// Non numeric suffixes such as 1.1.1w are compared as strings after the number
+func compareVersions(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xs := splitVersionPart(x)
+		yn, ys := splitVersionPart(y)
+		switch {
+		case xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case xs != ys:
+			if xs < ys {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+func splitVersionPart(part string) (int, string) {
+	i := 0
+	for i < len(part) && part[i] >= '0' && part[i] <= '9' {
+		i++
+	}
+	n, _ := strconv.Atoi(part[:i])
+	return n, part[i:]
+}
+
+// versionPattern finds a version in the --version output of a command
+var versionPattern = regexp.MustCompile(`\d+(?:\.\d+)+[a-z]?|\b\d+\b`)
+
+// receiptVersion reads the version from a ferment receipt directory, or returns an empty string
+func receiptVersion(receipt string) string {
+	content, err := os.ReadFile(filepath.Join(receipt, ".FERMENT", "metadata.json"))
+	if err == nil {
+		var metadata struct {
+			Version string `json:"version"`
+		}
+		if json.Unmarshal(content, &metadata) == nil && metadata.Version != "" {
+			return metadata.Version
+		}
+	}
+	for _, name := range []string{"VERSION", "version"} {
+		if content, err := os.ReadFile(filepath.Join(receipt, name)); err == nil {
+			return strings.TrimSpace(string(content))
+		}
+	}
+	return ""
+}
+
+// unsatisfiedError explains why the constraint of d can not be met
+func unsatisfiedError(d depSpec, installed string, provided string) error {
+	have := "not installed"
+	if installed != "" {
+		have = "installed " + installed
+	}
+	if provided == "" {
+		return fmt.Errorf("dependency %s is not satisfied (%s) and there is no barrell for %s", d, have, d.Package)
+	}
+	return fmt.Errorf("dependency %s is not satisfied (%s) and the %s barrell provides %s", d, have, d.Package, provided)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import "testing"
+
+func TestParseDepSpec(t *testing.T) {
+	tests := []struct {
+		in   string
+		want depSpec
+	}{
+		{"zlib", depSpec{Command: "zlib", Package: "zlib"}},
+		{"'zlib'", depSpec{Command: "zlib", Package: "zlib"}},
+		{"openssl>=3.0", depSpec{Command: "openssl", Package: "openssl", Op: ">=", Version: "3.0"}},
+		{"openssl > 1.1", depSpec{Command: "openssl", Package: "openssl", Op: ">", Version: "1.1"}},
+		{"cmake<=3.20", depSpec{Command: "cmake", Package: "cmake", Op: "<=", Version: "3.20"}},
+		{"go==1.18", depSpec{Command: "go", Package: "go", Op: "==", Version: "1.18"}},
+		{"gcc!=12", depSpec{Command: "gcc", Package: "gcc", Op: "!=", Version: "12"}},
+		{"meson~=1.2", depSpec{Command: "meson", Package: "meson", Op: "~=", Version: "1.2"}},
+		{"python3:python@3.11", depSpec{Command: "python3", Package: "python", Op: "@", Version: "3.11"}},
+		{"pkg-config", depSpec{Command: "pkg-config", Package: "pkgconfig"}},
+		{"Lib_XML2>=2.9", depSpec{Command: "Lib_XML2", Package: "libxml2", Op: ">=", Version: "2.9"}},
+		{"", depSpec{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := parseDepSpec(tt.in); got != tt.want {
+				t.Fatalf("parseDepSpec(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.10", "1.9", 1},
+		{"1.9", "1.10", -1},
+		{"2", "1.99.99", 1},
+		{"1.2.3", "1.2", 1},
+		{"1.1.1w", "1.1.1", 1},
+		{"1.1.1a", "1.1.1w", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := compareVersions(tt.a, tt.b); got != tt.want {
+				t.Fatalf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSatisfiedBy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		version string
+		want    bool
+	}{
+		{"zlib", "", true},
+		{"zlib", "1.2.13", true},
+		{"openssl>=3.0", "", false},
+		{"openssl>=3.0", "3.0", true},
+		{"openssl>=3.0", "3.1.2", true},
+		{"openssl>=3.0", "1.1.1w", false},
+		{"openssl>3.0", "3.0", false},
+		{"openssl>3.0", "3.0.1", true},
+		{"cmake<3.20", "3.9", true},
+		{"cmake<3.20", "3.20", false},
+		{"cmake<=3.20", "3.20.0", true},
+		{"go==1.18", "1.18.0", true},
+		{"go==1.18", "1.18.1", false},
+		{"gcc!=12", "12.0", false},
+		{"gcc!=12", "11.4", true},
+		{"python@3.11", "3.11", true},
+		{"python@3.11", "3.11.4", true},
+		{"python@3.11", "3.1", false},
+		{"python@3.11", "3.12.0", false},
+		{"meson~=1.2", "1.2", true},
+		{"meson~=1.2", "1.9", true},
+		{"meson~=1.2", "1.1", false},
+		{"meson~=1.2", "2.0", false},
+		{"meson~=1.2.3", "1.2.5", true},
+		{"meson~=1.2.3", "1.3.0", false},
+		{"meson~=2", "3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.version, func(t *testing.T) {
+			if got := parseDepSpec(tt.spec).satisfiedBy(tt.version); got != tt.want {
+				t.Fatalf("%s satisfiedBy(%q) = %v, want %v", tt.spec, tt.version, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// depGraph maps every package to the packages it depends on
+type depGraph struct {
+	deps map[string][]string
+}
+
+func newDepGraph() *depGraph {
+	return &depGraph{deps: make(map[string][]string)}
+}
+
+// add records pkg and its dependencies, dependencies are added as nodes as well
+func (g *depGraph) add(pkg string, deps []string) {
+	g.deps[pkg] = append(g.deps[pkg], deps...)
+	for _, dep := range deps {
+		if _, ok := g.deps[dep]; !ok {
+			g.deps[dep] = nil
+		}
+	}
+}
+
+// packages returns every node of the graph in sorted order
+func (g *depGraph) packages() []string {
+	var pkgs []string
+	for pkg := range g.deps {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// dependents returns the reverse edges of the graph
+func (g *depGraph) dependents() map[string][]string {
+	rev := make(map[string][]string)
+	for _, pkg := range g.packages() {
+		for _, dep := range g.deps[pkg] {
+			rev[dep] = append(rev[dep], pkg)
+		}
+	}
+	return rev
+}
+
+// topoOrder returns the packages with every dependency before its dependents
+// Ties are broken alphabetically so the order is stable
+func (g *depGraph) topoOrder() ([]string, error) {
+	indegree := make(map[string]int)
+	for pkg, deps := range g.deps {
+		indegree[pkg] = len(deps)
+	}
+	rev := g.dependents()
+	var ready []string
+	for _, pkg := range g.packages() {
+		if indegree[pkg] == 0 {
+			ready = append(ready, pkg)
+		}
+	}
+	var order []string
+	for len(ready) > 0 {
+		pkg := ready[0]
+		ready = ready[1:]
+		order = append(order, pkg)
+		for _, dependent := range rev[pkg] {
+			indegree[dependent]--
+			if indegree[dependent] == 0 {
+				ready = append(ready, dependent)
+				sort.Strings(ready)
+			}
+		}
+	}
+	if len(order) != len(g.deps) {
+		return order, fmt.Errorf("dependency cycle: %s", strings.Join(g.findCycle(), " -> "))
+	}
+	return order, nil
+}
+
+// findCycle returns one dependency cycle, starting and ending with the same package
+func (g *depGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var cycle []string
+	var visit func(pkg string) bool
+	visit = func(pkg string) bool {
+		state[pkg] = visiting
+		stack = append(stack, pkg)
+		for _, dep := range g.deps[pkg] {
+			switch state[dep] {
+			case visiting:
+				for i, p := range stack {
+					if p == dep {
+						cycle = append(append([]string{}, stack[i:]...), dep)
+						return true
+					}
+				}
+			case unvisited:
+				if visit(dep) {
+					return true
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[pkg] = visited
+		return false
+	}
+	for _, pkg := range g.packages() {
+		if state[pkg] == unvisited && visit(pkg) {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopoOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		edges   map[string][]string
+		want    []string
+		wantErr bool
+	}{
+		{"no dependencies", map[string][]string{"b": nil, "a": nil}, []string{"a", "b"}, false},
+		{"chain", map[string][]string{"app": {"lib"}, "lib": {"zlib"}}, []string{"zlib", "lib", "app"}, false},
+		{"diamond", map[string][]string{"app": {"left", "right"}, "left": {"base"}, "right": {"base"}}, []string{"base", "left", "right", "app"}, false},
+		{"ties stay alphabetical", map[string][]string{"c": {"a"}, "b": {"a"}, "d": nil}, []string{"a", "b", "c", "d"}, false},
+		{"cycle", map[string][]string{"a": {"b"}, "b": {"a"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newDepGraph()
+			for pkg, deps := range tt.edges {
+				g.add(pkg, deps)
+			}
+			got, err := g.topoOrder()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "cycle") {
+					t.Fatalf("topoOrder() error = %v, want a dependency cycle", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("topoOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// depsCmd represents the deps command
+var depsCmd = &cobra.Command{
+	Use:   "deps <package>",
+	Short: "Show the full dependency closure of a package",
+	Long: `Reads the dependencies of a package and of every barrell it depends on, reports cycles and
+dependencies without a barrell and prints the closure as a tree, a flat install order, JSON, DOT or Mermaid`,
+	Run: func(cmd *cobra.Command, args []string) {
+		barrellsLoc, err := cmd.Flags().GetString("barrells")
+		if err != nil {
+			panic(err)
+		}
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			panic(err)
+		}
+		phase, err := cmd.Flags().GetString("for")
+		if err != nil {
+			panic(err)
+		}
+		var sets []string
+		switch phase {
+		case "build":
+			sets = buildSets
+		case "runtime":
+			sets = []string{runtimeDependencies}
+		case "test":
+			sets = testSets
+		default:
+			color.Red("ERROR: Unknown phase %s, use build, runtime or test", phase)
+			os.Exit(1)
+		}
+		if dir, err := isDir(barrellsLoc); err != nil || !dir {
+			color.Red("ERROR: Barrells location is not a directory or does not exist")
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			color.Red("ERROR: Please specify a package")
+			os.Exit(1)
+		}
+		pkg := convertToReadableString(strings.ToLower(args[0]))
+		if !doesExist(barrellPath(pkg, barrellsLoc)) {
+			color.Red("ERROR: Package not found in %s\n", barrellsLoc)
+			os.Exit(1)
+		}
+		r, err := resolveDependencies(pkg, barrellsLoc, sets...)
+		if err != nil {
+			color.Red("ERROR - DEPS: %s", err)
+			os.Exit(1)
+		}
+		switch format {
+		case "tree":
+			printDepsTree(os.Stdout, r)
+		case "flat":
+			for _, p := range r.Order {
+				if p != r.Root {
+					fmt.Println(p)
+				}
+			}
+		case "json":
+			err = printDepsJSON(os.Stdout, r)
+		case "dot":
+			printDepsDot(os.Stdout, r)
+		case "mermaid":
+			printDepsMermaid(os.Stdout, r)
+		default:
+			color.Red("ERROR: Unknown format %s, use tree, flat, json, dot or mermaid", format)
+			os.Exit(1)
+		}
+		if err != nil {
+			color.Red("ERROR - DEPS: %s", err)
+			os.Exit(1)
+		}
+		if format == "tree" || format == "flat" {
+			for _, name := range r.missing() {
+				color.Yellow("WARNING: no barrell for %s, needed by %s", name, strings.Join(r.Missing[name], ", "))
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(depsCmd)
+	location, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	location = location[:len(location)-len("/fermenter")]
+	depsCmd.Flags().String("barrells", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
+	depsCmd.Flags().StringP("format", "f", "tree", "Output format: tree, flat, json, dot or mermaid")
+	depsCmd.Flags().String("for", "build", "Dependencies needed for build, runtime or test")
+}
+
+// printDepsTree prints the closure as a tree, packages already shown are marked with (*) and not expanded again
+func printDepsTree(w io.Writer, r *resolution) {
+	fmt.Fprintln(w, r.Root)
+	shown := make(map[string]bool)
+	var walk func(pkg string, prefix string)
+	walk = func(pkg string, prefix string) {
+		children := append([]string{}, r.dependencies(pkg)...)
+		for _, name := range r.missing() {
+			if containsString(r.Missing[name], pkg) {
+				children = append(children, name)
+			}
+		}
+		for i, child := range children {
+			branch, next := "├── ", "│   "
+			if i == len(children)-1 {
+				branch, next = "└── ", "    "
+			}
+			switch {
+			case r.Missing[child] != nil:
+				fmt.Fprintf(w, "%s%s%s (no barrell)\n", prefix, branch, child)
+			case shown[child]:
+				fmt.Fprintf(w, "%s%s%s (*)\n", prefix, branch, child)
+			default:
+				shown[child] = true
+				fmt.Fprintf(w, "%s%s%s\n", prefix, branch, child)
+				walk(child, prefix+next)
+			}
+		}
+	}
+	walk(r.Root, "")
+}
+
+func printDepsJSON(w io.Writer, r *resolution) error {
+	out := struct {
+		Package      string              `json:"package"`
+		Order        []string            `json:"order"`
+		Dependencies map[string][]string `json:"dependencies"`
+		Missing      map[string][]string `json:"missing"`
+	}{r.Root, r.Order, make(map[string][]string), r.Missing}
+	for _, pkg := range r.Order {
+		out.Dependencies[pkg] = append([]string{}, r.dependencies(pkg)...)
+	}
+	content, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, string(content))
+	return nil
+}
+func printDepsDot(w io.Writer, r *resolution) {
+	fmt.Fprintln(w, "digraph dependencies {")
+	for _, pkg := range r.Order {
+		fmt.Fprintf(w, "  %q;\n", pkg)
+		for _, dep := range r.dependencies(pkg) {
+			fmt.Fprintf(w, "  %q -> %q;\n", pkg, dep)
+		}
+	}
+	for _, name := range r.missing() {
+		fmt.Fprintf(w, "  %q [style=dashed];\n", name)
+		for _, pkg := range r.Missing[name] {
+			fmt.Fprintf(w, "  %q -> %q [style=dashed];\n", pkg, name)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+func printDepsMermaid(w io.Writer, r *resolution) {
+	ids := make(map[string]string)
+	id := func(pkg string) string {
+		if _, ok := ids[pkg]; !ok {
+			ids[pkg] = fmt.Sprintf("n%d", len(ids))
+		}
+		return ids[pkg]
+	}
+	fmt.Fprintln(w, "graph TD")
+	for _, pkg := range r.Order {
+		fmt.Fprintf(w, "  %s[\"%s\"]\n", id(pkg), pkg)
+	}
+	for _, name := range r.missing() {
+		fmt.Fprintf(w, "  %s[\"%s (no barrell)\"]\n", id(name), name)
+	}
+	for _, pkg := range r.Order {
+		for _, dep := range r.dependencies(pkg) {
+			fmt.Fprintf(w, "  %s --> %s\n", id(pkg), id(dep))
+		}
+	}
+	for _, name := range r.missing() {
+		for _, pkg := range r.Missing[name] {
+			fmt.Fprintf(w, "  %s -.-> %s\n", id(pkg), id(name))
+		}
+	}
+}
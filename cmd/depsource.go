@@ -0,0 +1,170 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// dependencySource is where missing barrell dependencies are installed from
+// The zero value installs them with the ferment client
+type dependencySource struct {
+	// FromSource builds dependencies with the build pipeline
+	FromSource bool
+	// ArtifactDir holds locally built prebuild archives dependencies are installed from
+	ArtifactDir string
+}
+
+// readDependencySource reads --deps-from-source and --deps-from, which can not be combined
+func readDependencySource(cmd *cobra.Command) (dependencySource, error) {
+	var s dependencySource
+	var err error
+	s.FromSource, err = cmd.Flags().GetBool("deps-from-source")
+	if err != nil {
+		panic(err)
+	}
+	s.ArtifactDir, err = cmd.Flags().GetString("deps-from")
+	if err != nil {
+		panic(err)
+	}
+	if s.FromSource && s.ArtifactDir != "" {
+		return s, errors.New("--deps-from and --deps-from-source can not be used together")
+	}
+	return s, nil
+}
+
+// addDependencySourceFlags registers the flags read by readDependencySource
+func addDependencySourceFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("deps-from-source", false, "Build missing barrell dependencies from source instead of running ferment install")
+	cmd.Flags().String("deps-from", "", "Install missing barrell dependencies from the prebuild archives in this directory, others with ferment install")
+}
+
+// dependencyRoot is the workspace root dependencies are built or unpacked in
+func dependencyRoot() string {
+	return filepath.Join(workspaceRoot, "deps")
+}
+
+// buildingFromSource holds the dependencies currently being built, to stop on cycles through build dependencies
+var buildingFromSource = make(map[string]bool)
+
+// install installs the barrell dependency pkg, upgrade is set when an older version is installed
+func (s dependencySource) install(pkg string, upgrade bool, barrellsLoc string) error {
+	switch {
+	case s.archiveFor(pkg) != "":
+		return s.installFromArchive(pkg, s.archiveFor(pkg), barrellsLoc)
+	case s.FromSource:
+		return s.buildFromSource(pkg, barrellsLoc)
+	}
+	//ferment always installs into the default prefix, receipts would be looked up in the wrong place
+	if fermentPrefix() != defaultPrefix {
+		return fmt.Errorf("ferment installs %s into %s but the prefix is %s, use --deps-from or --deps-from-source", pkg, defaultPrefix, fermentPrefix())
+	}
+	action := "install"
+	if upgrade {
+		action = "upgrade"
+	}
+	cmd := exec.Command("ferment", action, pkg)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stderr
+	cmd.Stdin = os.Stdin
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ferment %s %s: %s", action, pkg, err)
+	}
+	return nil
+}
+
+// buildFromSource runs the pipeline of pkg up to the install phase, its own dependencies come from s as well
+func (s dependencySource) buildFromSource(pkg string, barrellsLoc string) error {
+	if buildingFromSource[pkg] {
+		return fmt.Errorf("dependency cycle while building %s from source", pkg)
+	}
+	buildingFromSource[pkg] = true
+	defer delete(buildingFromSource, pkg)
+	root := workspaceRoot
+	defer func() { workspaceRoot = root }()
+	color.Yellow("Building dependency %s from source", pkg)
+	opts := buildOptions{Barrells: barrellsLoc, NoUpload: true, Deps: s}
+	t := newBuildTarget(barrellPath(pkg, barrellsLoc), pkg, "", false, dependencyRoot(), opts)
+	if _, err := runPipeline(t, phaseSelection{To: "install"}, nil); err != nil {
+		return fmt.Errorf("building dependency %s: %s", pkg, err)
+	}
+	if err := writePackageMetadata(t); err != nil {
+		return err
+	}
+	return writeReceipt(pkg, workspaceDir(pkg))
+}
+
+// archiveFor returns the prebuild archive of pkg in the artifact directory, or "" when there is none
+// Dependencies without an archive are installed with ferment install instead
+func (s dependencySource) archiveFor(pkg string) string {
+	if s.ArtifactDir == "" {
+		return ""
+	}
+	for _, name := range []string{fmt.Sprintf("%s-%s.tar.gz", pkg, runtime.GOARCH), pkg + ".tar.gz"} {
+		if doesExist(filepath.Join(s.ArtifactDir, name)) {
+			return filepath.Join(s.ArtifactDir, name)
+		}
+	}
+	return ""
+}
+
+// installFromArchive unpacks the prebuild archive of pkg and installs it
+func (s dependencySource) installFromArchive(pkg string, archive string, barrellsLoc string) error {
+	root := workspaceRoot
+	defer func() { workspaceRoot = root }()
+	workspaceRoot = dependencyRoot()
+	color.Yellow("Installing dependency %s from %s", pkg, archive)
+	if err := os.MkdirAll(workspaceRoot, 0777); err != nil {
+		return err
+	}
+	os.RemoveAll(workspaceDir(pkg))
+	if err := Untar(workspaceRoot, archive, pkg); err != nil {
+		return fmt.Errorf("unpacking %s: %s", archive, err)
+	}
+	unlock, err := lockInstalls()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := installPKG(pkg, barrellsLoc); err != nil {
+		return err
+	}
+	return writeReceipt(pkg, workspaceDir(pkg))
+}
+
+// writeReceipt records pkg as installed so probes and version constraints see it
+// The receipt holds the metadata and the files manifest of the package unpacked at dir
+func writeReceipt(pkg string, dir string) error {
+	content, err := os.ReadFile(filepath.Join(dir, metadataDir, "metadata.json"))
+	if err != nil {
+		//prebuilds from before metadata was added only get their name recorded
+		content, err = json.Marshal(packageMetadata{Name: pkg})
+		if err != nil {
+			return err
+		}
+	}
+	receipt := filepath.Join(installedDir(), pkg, metadataDir)
+	if err := os.MkdirAll(receipt, 0755); err != nil {
+		color.Yellow("WARNING - RECEIPT: %s", err)
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(receipt, "metadata.json"), content, 0644); err != nil {
+		color.Yellow("WARNING - RECEIPT: %s", err)
+	}
+	if manifest, err := os.ReadFile(filepath.Join(dir, metadataDir, filesManifest)); err == nil {
+		if err := os.WriteFile(filepath.Join(receipt, filesManifest), manifest, 0644); err != nil {
+			color.Yellow("WARNING - RECEIPT: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fatArchHeader mirrors struct fat_arch from <mach-o/fat.h>
+type fatArchHeader struct {
+	CPU    uint32
+	SubCPU uint32
+	Offset uint32
+	Size   uint32
+	Align  uint32
+}
+
+// fatAlign returns the log2 alignment lipo uses for a slice of the given cpu
+func fatAlign(cpu macho.Cpu) uint32 {
+	switch cpu {
+	case macho.CpuArm64, macho.CpuArm:
+		return 14
+	}
+	return 12
+}
+
+// writeFatMacho merges thin Mach-O files into a single fat (universal) file at out
+func writeFatMacho(out string, inputs []string) error {
+	if len(inputs) == 0 {
+		return errors.New("no inputs for fat binary")
+	}
+	headers := make([]fatArchHeader, len(inputs))
+	contents := make([][]byte, len(inputs))
+	offset := uint32(8 + 20*len(inputs))
+	for i, input := range inputs {
+		content, err := os.ReadFile(input)
+		if err != nil {
+			return err
+		}
+		mf, err := macho.NewFile(bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("%s: %s", input, err)
+		}
+		for _, h := range headers[:i] {
+			if h.CPU == uint32(mf.Cpu) {
+				return fmt.Errorf("%s: duplicate cpu %s", input, mf.Cpu)
+			}
+		}
+		if uint64(len(content)) > uint64(^uint32(0)) {
+			return fmt.Errorf("%s: too large for a 32-bit fat header", input)
+		}
+		align := fatAlign(mf.Cpu)
+		offset = (offset + (1 << align) - 1) &^ ((1 << align) - 1)
+		headers[i] = fatArchHeader{
+			CPU:    uint32(mf.Cpu),
+			SubCPU: mf.SubCpu,
+			Offset: offset,
+			Size:   uint32(len(content)),
+			Align:  align,
+		}
+		contents[i] = content
+		offset += uint32(len(content))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(machoFatMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(len(headers)))
+	for _, h := range headers {
+		binary.Write(&buf, binary.BigEndian, h)
+	}
+	for i, h := range headers {
+		buf.Write(make([]byte, int(h.Offset)-buf.Len()))
+		buf.Write(contents[i])
+	}
+	stat, err := os.Stat(inputs[0])
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), stat.Mode().Perm())
+}
+
+// mergeUniversal combines an amd64 and an arm64 build tree into out
+// Identical files are copied as-is and thin Mach-O pairs become fat binaries
+// Returns a list of problems such as files only present in one build
+func mergeUniversal(amd64Dir string, arm64Dir string, out string) ([]string, error) {
+	amd64Files, err := listTree(amd64Dir)
+	if err != nil {
+		return nil, err
+	}
+	arm64Files, err := listTree(arm64Dir)
+	if err != nil {
+		return nil, err
+	}
+	var all []string
+	for rel := range amd64Files {
+		all = append(all, rel)
+	}
+	for rel := range arm64Files {
+		if _, ok := amd64Files[rel]; !ok {
+			all = append(all, rel)
+		}
+	}
+	//parents sort before their children so directories exist before files are written
+	sort.Strings(all)
+	if err := os.MkdirAll(out, 0777); err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, rel := range all {
+		amdMode, inAmd := amd64Files[rel]
+		armMode, inArm := arm64Files[rel]
+		amdPath := filepath.Join(amd64Dir, rel)
+		armPath := filepath.Join(arm64Dir, rel)
+		dst := filepath.Join(out, rel)
+		src := amdPath
+		switch {
+		case !inArm:
+			problems = append(problems, fmt.Sprintf("%s: only in amd64 build", rel))
+		case !inAmd:
+			problems = append(problems, fmt.Sprintf("%s: only in arm64 build", rel))
+			src = armPath
+			amdMode = armMode
+		case amdMode.Type() != armMode.Type():
+			problems = append(problems, fmt.Sprintf("%s: file type differs between builds", rel))
+		}
+		switch {
+		case amdMode.IsDir():
+			if err := os.MkdirAll(dst, amdMode.Perm()); err != nil {
+				return problems, err
+			}
+		case amdMode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return problems, err
+			}
+			if inAmd && inArm {
+				if other, err := os.Readlink(armPath); err == nil && other != target {
+					problems = append(problems, fmt.Sprintf("%s: symlink target differs between builds", rel))
+				}
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return problems, err
+			}
+		default:
+			if inAmd && inArm && amdMode.Type() == armMode.Type() {
+				same, err := sameContent(amdPath, armPath)
+				if err != nil {
+					return problems, err
+				}
+				if !same {
+					merged, err := mergeMachoPair(amdPath, armPath, dst)
+					if err != nil {
+						return problems, err
+					}
+					if merged {
+						continue
+					}
+					problems = append(problems, fmt.Sprintf("%s: differs between builds and is not a Mach-O binary, using amd64 copy", rel))
+				}
+			}
+			if err := copyFile(src, dst, amdMode.Perm()); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// mergeMachoPair writes a fat binary to dst when amd64Path and arm64Path are thin Mach-O files of the right arches
+func mergeMachoPair(amd64Path string, arm64Path string, dst string) (bool, error) {
+	amdInfo, ok, err := readBinaryInfo(amd64Path)
+	if err != nil || !ok || amdInfo.Format != "Mach-O" || amdInfo.Arches[0] != "amd64" {
+		return false, err
+	}
+	armInfo, ok, err := readBinaryInfo(arm64Path)
+	if err != nil || !ok || armInfo.Format != "Mach-O" || armInfo.Arches[0] != "arm64" {
+		return false, err
+	}
+	return true, writeFatMacho(dst, []string{amd64Path, arm64Path})
+}
+
+// listTree returns every path below root relative to root, skipping .git
+func listTree(root string) (map[string]fs.FileMode, error) {
+	files := make(map[string]fs.FileMode)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = info.Mode()
+		return nil
+	})
+	return files, err
+}
+func sameContent(a string, b string) (bool, error) {
+	ca, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	cb, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ca, cb), nil
+}
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
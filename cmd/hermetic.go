@@ -0,0 +1,125 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// isolatedNetwork is set while the build and install of a barrell run without network access
+var isolatedNetwork bool
+
+// commandMarker prefixes the commands a hermetic build starts in its build log
+const commandMarker = "fermenter: running "
+
+// networkErrors are output lines that show a command tried to reach the network
+var networkErrors = []string{
+	"hermetic build: network access",
+	"Could not resolve host",
+	"Temporary failure in name resolution",
+	"Name or service not known",
+	"nodename nor servname provided",
+	"Network is unreachable",
+	"getaddrinfo ENOTFOUND",
+	"getaddrinfo EAI_AGAIN",
+	"Failed to establish a new connection",
+	"unable to access 'http",
+}
+
+// networkPreamble is run before the barrell, it brings up loopback in the new network namespace and
+// makes python itself refuse to reach the network. With logCommands every command the barrell starts
+// is written to stderr so a network error in the build log can be traced back to its command
+func networkPreamble(logCommands bool) string {
+	return fmt.Sprintf(`
+def _fermenter_hermetic(log_commands):
+    import os, socket, struct, sys
+    try:
+        import fcntl
+        fcntl.ioctl(socket.socket(socket.AF_INET, socket.SOCK_DGRAM), 0x8914, struct.pack("16sH14x", b"lo", 0x41))
+    except OSError:
+        pass
+    def audit(event, args):
+        if log_commands and event in ("subprocess.Popen", "os.system", "os.exec", "os.posix_spawn"):
+            command = args[0] if event == "os.system" else args[1]
+            if isinstance(command, bytes):
+                command = command.decode(errors="replace")
+            if not isinstance(command, str):
+                command = " ".join(str(a) for a in command)
+            os.write(2, ("%s%%s\n" %% command).encode())
+        elif event in ("socket.getaddrinfo", "socket.connect"):
+            host = args[0] if event == "socket.getaddrinfo" else args[1]
+            if isinstance(host, tuple):
+                host = host[0]
+            if isinstance(host, str) and host not in ("", "localhost", "127.0.0.1", "::1") and not host.startswith("/"):
+                raise OSError("hermetic build: network access to %%s is not allowed, set network = True in the barrell if it is required" %% host)
+    sys.addaudithook(audit)
+_fermenter_hermetic(%s)
+del _fermenter_hermetic
+`, commandMarker, pythonBool(logCommands))
+}
+func pythonBool(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+// resolveNetwork decides whether t builds without network, barrells opt out with network = True
+func resolveNetwork(t *buildTarget) error {
+	isolatedNetwork = false
+	if !t.Options.Hermetic {
+		return nil
+	}
+	declared, err := getBarrellAttribute(t.Package, "network", t.Options.Barrells)
+	if err != nil {
+		return err
+	}
+	if declared == "True" {
+		color.Yellow("WARNING - HERMETIC: %s declares network = True, building with network access", t.Package)
+		t.State.Outputs["network"] = "declared"
+		return nil
+	}
+	isolatedNetwork = true
+	t.State.Outputs["network"] = "isolated"
+	return nil
+}
+
+// findNetworkFailure looks for a network error in the build log at path
+// Returns the error line and the last command started before it
+func findNetworkFailure(path string) (string, string, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+	var command string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, commandMarker) {
+			command = strings.TrimPrefix(line, commandMarker)
+			continue
+		}
+		for _, signature := range networkErrors {
+			if strings.Contains(line, signature) {
+				return strings.TrimSpace(line), command, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// networkFailureError explains a failed hermetic build that tried to reach the network
+func networkFailureError(line string, command string) error {
+	if command == "" {
+		return fmt.Errorf("network access during hermetic build: %s", line)
+	}
+	return fmt.Errorf("network access during hermetic build by `%s`: %s", command, line)
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd
+
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/fatih/color"
+)
+
+// lockInstalls waits until no other fermenter process installs into the prefix and returns the unlock function
+// Parallel builds watch the same prefix and append to the same log, only one of them may install at a time
+func lockInstalls() (func(), error) {
+	f, err := os.OpenFile(installLockPath(), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		color.Yellow("Waiting for another build to finish installing into %s", fermentPrefix())
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+// lockInstalls does nothing without flock, parallel builds are not serialized on this platform
+func lockInstalls() (func(), error) {
+	return func() {}, nil
+}
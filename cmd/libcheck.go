@@ -0,0 +1,346 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// systemLibraries are shared libraries every user has, matched against the base name of a needed library
+// Barrells can allow more with self.allowed_libraries = ["libGL.so.*"]
+var systemLibraries = []string{
+	"libc.so.*", "libm.so.*", "libpthread.so.*", "libdl.so.*", "librt.so.*", "libutil.so.*",
+	"libresolv.so.*", "libcrypt.so.*", "libnsl.so.*", "ld-linux*.so.*", "ld64.so.*", "linux-vdso.so.*",
+	"libgcc_s.so.*", "libstdc++.so.*", "libatomic.so.*", "libc++.*.dylib", "libSystem.B.dylib", "libobjc.A.dylib",
+}
+
+// systemLibraryDirs hold Mach-O libraries and frameworks that ship with macOS
+var systemLibraryDirs = []string{"/usr/lib/", "/System/Library/"}
+
+// Ways a needed library can be resolved
+const (
+	libraryInPackage  = "package"
+	librarySystem     = "system"
+	libraryDependency = "dependency"
+	libraryUndeclared = "undeclared"
+	libraryUnresolved = "unresolved"
+	libraryBuildOnly  = "build dependency"
+)
+
+// linkedBinary is the dynamic linking information of an ELF or Mach-O binary
+type linkedBinary struct {
+	Path string
+	// Needed are the DT_NEEDED or LC_LOAD_DYLIB entries
+	Needed []string
+	// Rpaths are the DT_RPATH and DT_RUNPATH or LC_RPATH entries
+	Rpaths []string
+}
+
+// linkedLibrary is a library needed by a binary of the package and where it was found
+type linkedLibrary struct {
+	Binary  string
+	Library string
+	Kind    string
+	// Provider is the file or the dependency the library was resolved to
+	Provider string
+}
+
+func (l linkedLibrary) problem() bool {
+	return l.Kind == libraryUndeclared || l.Kind == libraryUnresolved || l.Kind == libraryBuildOnly
+}
+func (l linkedLibrary) String() string {
+	switch l.Kind {
+	case libraryUndeclared:
+		return fmt.Sprintf("%s needs %s, which is on the build machine but not provided by a declared dependency", l.Binary, l.Library)
+	case libraryUnresolved:
+		return fmt.Sprintf("%s needs %s, which is not in the package, a dependency or the system", l.Binary, l.Library)
+	case libraryBuildOnly:
+		return fmt.Sprintf("%s needs %s from %s, which is only a build dependency", l.Binary, l.Library, l.Provider)
+	}
+	return fmt.Sprintf("%s needs %s (%s %s)", l.Binary, l.Library, l.Kind, l.Provider)
+}
+
+// readLinkedBinary reads the needed libraries and rpaths of the binary at path
+// Fat Mach-O files report the libraries of every arch
+func readLinkedBinary(path string) (linkedBinary, error) {
+	b := linkedBinary{Path: path}
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		b.Needed, _ = f.ImportedLibraries()
+		for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+			values, _ := f.DynString(tag)
+			for _, value := range values {
+				b.Rpaths = append(b.Rpaths, filepath.SplitList(value)...)
+			}
+		}
+		return b, nil
+	}
+	var files []*macho.File
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		files = append(files, f)
+	} else if fat, err := macho.OpenFat(path); err == nil {
+		defer fat.Close()
+		for _, arch := range fat.Arches {
+			files = append(files, arch.File)
+		}
+	} else {
+		return b, fmt.Errorf("%s is not an ELF or Mach-O file", path)
+	}
+	for _, f := range files {
+		libs, _ := f.ImportedLibraries()
+		for _, lib := range libs {
+			if !containsString(b.Needed, lib) {
+				b.Needed = append(b.Needed, lib)
+			}
+		}
+		for _, load := range f.Loads {
+			if rpath, ok := load.(*macho.Rpath); ok && !containsString(b.Rpaths, rpath.Path) {
+				b.Rpaths = append(b.Rpaths, rpath.Path)
+			}
+		}
+	}
+	return b, nil
+}
+
+// libraryResolver resolves the libraries needed by the binaries of a package
+type libraryResolver struct {
+	root string
+	// files are the files of the package by base name
+	files map[string][]string
+	// allowed are the system library patterns including the ones allowed by the barrell
+	allowed []string
+	// providers are the libraries provided by each declared dependency, by base name
+	providers map[string]string
+	// buildOnly are the libraries provided by build dependencies only
+	buildOnly map[string]string
+}
+
+// newLibraryResolver indexes the package at root and the installed files of the dependencies of t
+func newLibraryResolver(t *buildTarget, root string) (*libraryResolver, error) {
+	r := &libraryResolver{
+		root:      root,
+		files:     make(map[string][]string),
+		allowed:   append([]string{}, systemLibraries...),
+		providers: make(map[string]string),
+		buildOnly: make(map[string]string),
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			r.files[d.Name()] = append(r.files[d.Name()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := getBarrellList(t.Package, "allowed_libraries", t.Options.Barrells)
+	if err != nil {
+		return nil, err
+	}
+	r.allowed = append(r.allowed, allowed...)
+	probes, err := getBarrellProbes(t.Package, t.Options.Barrells)
+	if err != nil {
+		return nil, err
+	}
+	buildOnly, err := getDependencySet(t.Path, t.Package, buildDependencies)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range buildOnly {
+		dep := dependencyPackage(spec)
+		r.index(r.buildOnly, dep, probes[dep])
+	}
+	deps, err := getDependencies(t.Path, t.Package)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range deps {
+		dep := dependencyPackage(spec)
+		r.index(r.providers, dep, probes[dep])
+	}
+	return r, nil
+}
+
+// index records the libraries of dep found in its ferment receipt, its dependency workspace and its library probes
+func (r *libraryResolver) index(libs map[string]string, dep string, declared []string) {
+	for _, dir := range []string{filepath.Join(installedDir(), dep), filepath.Join(dependencyRoot(), dep)} {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !d.IsDir() && librarySuffix.MatchString(d.Name()) {
+				libs[d.Name()] = dep
+				libs[libraryProbe(d.Name()).name()] = dep
+			}
+			return nil
+		})
+	}
+	for _, declaration := range declared {
+		if p, err := parseProbe(declaration); err == nil {
+			if library, ok := p.(libraryProbe); ok {
+				libs[library.name()] = dep
+			}
+		}
+	}
+}
+
+// provider looks lib up in libs by its base name or by its name without the shared library suffix
+func provider(libs map[string]string, lib string) (string, bool) {
+	if dep, ok := libs[lib]; ok {
+		return dep, true
+	}
+	dep, ok := libs[libraryProbe(lib).name()]
+	return dep, ok
+}
+
+// resolve finds where the library lib needed by the binary at bin comes from
+func (r *libraryResolver) resolve(bin linkedBinary, lib string) linkedLibrary {
+	rel, err := filepath.Rel(r.root, bin.Path)
+	if err != nil {
+		rel = bin.Path
+	}
+	l := linkedLibrary{Binary: rel, Library: lib}
+	base := path.Base(lib)
+	for _, candidate := range r.candidates(bin, lib) {
+		if strings.HasPrefix(candidate, r.root+string(filepath.Separator)) && doesExist(candidate) {
+			l.Kind, l.Provider = libraryInPackage, candidate
+			return l
+		}
+	}
+	if files := r.files[base]; len(files) > 0 {
+		l.Kind, l.Provider = libraryInPackage, files[0]
+		return l
+	}
+	for _, dir := range systemLibraryDirs {
+		if strings.HasPrefix(lib, dir) {
+			l.Kind, l.Provider = librarySystem, lib
+			return l
+		}
+	}
+	for _, pattern := range r.allowed {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			l.Kind, l.Provider = librarySystem, pattern
+			return l
+		}
+	}
+	if dep, ok := provider(r.providers, base); ok {
+		l.Kind, l.Provider = libraryDependency, dep
+		return l
+	}
+	if dep, ok := provider(r.buildOnly, base); ok {
+		l.Kind, l.Provider = libraryBuildOnly, dep
+		return l
+	}
+	if strings.HasPrefix(lib, "/") && doesExist(lib) {
+		l.Kind, l.Provider = libraryUndeclared, lib
+		return l
+	}
+	if _, ok := libraryProbe(base).probe(); ok {
+		l.Kind = libraryUndeclared
+		return l
+	}
+	l.Kind = libraryUnresolved
+	return l
+}
+
+// candidates expands $ORIGIN, @loader_path, @executable_path and @rpath in lib to the paths the loader would try
+func (r *libraryResolver) candidates(bin linkedBinary, lib string) []string {
+	origin := filepath.Dir(bin.Path)
+	expand := func(p string) string {
+		for _, token := range []string{"$ORIGIN", "${ORIGIN}", "@loader_path", "@executable_path"} {
+			p = strings.ReplaceAll(p, token, origin)
+		}
+		return filepath.Clean(p)
+	}
+	if strings.HasPrefix(lib, "@rpath/") {
+		var paths []string
+		for _, rpath := range bin.Rpaths {
+			paths = append(paths, filepath.Join(expand(rpath), strings.TrimPrefix(lib, "@rpath/")))
+		}
+		return paths
+	}
+	if strings.Contains(lib, "/") {
+		return []string{expand(lib)}
+	}
+	var paths []string
+	for _, rpath := range bin.Rpaths {
+		paths = append(paths, filepath.Join(expand(rpath), lib))
+	}
+	return paths
+}
+
+// checkLibraries resolves every library needed by the binaries of the package of t
+// Undeclared and unresolved libraries are warnings, or an error when strict
+func checkLibraries(t *buildTarget, strict bool) error {
+	root := workspaceDir(t.Package)
+	r, err := newLibraryResolver(t, root)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	err = walkBinaries(root, func(info binaryInfo) error {
+		bin, err := readLinkedBinary(info.Path)
+		if err != nil {
+			return err
+		}
+		for _, lib := range bin.Needed {
+			l := r.resolve(bin, lib)
+			if l.problem() {
+				problems = append(problems, l.String())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(problems)
+	for _, problem := range problems {
+		if strict {
+			color.Red("ERROR - LIBRARIES: %s", problem)
+		} else {
+			color.Yellow("WARNING - LIBRARIES: %s", problem)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	//universal builds check each arch, keep the problems of both
+	recorded := problems
+	if previous := t.State.Outputs["libraryProblems"]; previous != "" {
+		recorded = append(strings.Split(previous, "\n"), problems...)
+	}
+	t.State.Outputs["libraryProblems"] = strings.Join(recorded, "\n")
+	if strict {
+		return fmt.Errorf("%d needed libraries are not provided by the package, the system or a dependency", len(problems))
+	}
+	return nil
+}
+
+// getBarrellList returns a list attribute of the barrell of pkg, or nil when it is not set
+func getBarrellList(pkg string, attr string, barrellsLoc string) ([]string, error) {
+	out, err := executeQuickPython(fmt.Sprintf("import json;from %s import %s;pkg=%s();v=getattr(pkg,'%s',[]);print(json.dumps(v if isinstance(v,list) else [v]))", pkg, pkg, pkg, attr), barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("%s of %s: %s", attr, pkg, err)
+	}
+	return list, nil
+}
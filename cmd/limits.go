@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// resourceLimits caps the resources a build and all of its children may use, zero values mean no limit
+type resourceLimits struct {
+	MemoryBytes int64
+	CPUs        float64
+	Pids        int64
+	// Required is set when the limits come from flags, a build then fails if they can not be enforced
+	Required bool
+}
+
+// buildLimits are applied to every barrell build started by this process
+var buildLimits resourceLimits
+
+func (l resourceLimits) enabled() bool {
+	return l.MemoryBytes > 0 || l.CPUs > 0 || l.Pids > 0
+}
+
+// parseByteSize parses sizes such as 512M, 4G or 4GiB into bytes
+func parseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// resolveLimits combines the limit flags with the max_memory, max_cpus and max_pids hints of the barrell
+// Flags take precedence over the barrell
+func resolveLimits(opts buildOptions, pkg string) (resourceLimits, error) {
+	var limits resourceLimits
+	var err error
+	memory := opts.MaxMemory
+	if memory == "" {
+		memory, err = getBarrellAttribute(pkg, "max_memory", opts.Barrells)
+		if err != nil {
+			return limits, err
+		}
+	} else {
+		limits.Required = true
+	}
+	if memory != "" {
+		limits.MemoryBytes, err = parseByteSize(memory)
+		if err != nil {
+			return limits, err
+		}
+	}
+	limits.CPUs = opts.MaxCPUs
+	if limits.CPUs > 0 {
+		limits.Required = true
+	} else {
+		hint, err := getBarrellAttribute(pkg, "max_cpus", opts.Barrells)
+		if err != nil {
+			return limits, err
+		}
+		if hint != "" {
+			limits.CPUs, err = strconv.ParseFloat(hint, 64)
+			if err != nil {
+				return limits, fmt.Errorf("invalid max_cpus %q", hint)
+			}
+		}
+	}
+	limits.Pids = opts.MaxPids
+	if limits.Pids > 0 {
+		limits.Required = true
+	} else {
+		hint, err := getBarrellAttribute(pkg, "max_pids", opts.Barrells)
+		if err != nil {
+			return limits, err
+		}
+		if hint != "" {
+			limits.Pids, err = strconv.ParseInt(hint, 10, 64)
+			if err != nil {
+				return limits, fmt.Errorf("invalid max_pids %q", hint)
+			}
+		}
+	}
+	return limits, nil
+}
+
+// limitBuild places the process with pid into a cgroup enforcing buildLimits
+// Returns a release func to call once the process exited, which reports the limit that was hit if the process failed
+// A build that succeeded was not stopped by a limit even when e.g. a child of it was killed for memory
+func limitBuild(pkg string, pid int) (func(failed bool) string, error) {
+	noop := func(failed bool) string { return "" }
+	if !buildLimits.enabled() {
+		return noop, nil
+	}
+	cg, err := newBuildCgroup(fmt.Sprintf("%s-%d", pkg, pid), buildLimits)
+	if err == nil {
+		err = cg.add(pid)
+		if err != nil {
+			cg.remove()
+		}
+	}
+	if err != nil {
+		if buildLimits.Required {
+			return noop, fmt.Errorf("unable to apply resource limits: %s", err)
+		}
+		color.Yellow("WARNING - LIMITS: ignoring barrell resource limits: %s", err)
+		return noop, nil
+	}
+	return func(failed bool) string {
+		var hit string
+		if failed {
+			hit = cg.limitHit()
+		}
+		cg.remove()
+		return hit
+	}, nil
+}
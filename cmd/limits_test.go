@@ -0,0 +1,38 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"20000000", 20000000, false},
+		{"8M", 8 << 20, false},
+		{"8MB", 8 << 20, false},
+		{"8MiB", 8 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"512k", 512 << 10, false},
+		{" 2T ", 2 << 40, false},
+		{"0", 0, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1M", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseByteSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("parseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
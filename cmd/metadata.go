@@ -0,0 +1,223 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadataDir is the directory inside a prebuild that holds its metadata
+const metadataDir = ".FERMENT"
+
+// filesManifest lists every file of the prebuild, one "sha256 mode size path" line per file
+const filesManifest = "files"
+
+// packageMetadata is written to .FERMENT/metadata.json in every prebuild so ferment install can read it
+type packageMetadata struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Revision    int    `json:"revision"`
+	Arch        string `json:"arch"`
+	OS          string `json:"os"`
+	Description string `json:"description,omitempty"`
+	Homepage    string `json:"homepage,omitempty"`
+	License     string `json:"license,omitempty"`
+	// Dependencies are the runtime dependencies ferment install has to pull in, build and test dependencies are left out
+	Dependencies []string `json:"dependencies"`
+	// Binaries are the executables ferment install links into the prefix
+	Binaries      []string `json:"binaries,omitempty"`
+	BarrellSHA256 string   `json:"barrellSha256,omitempty"`
+	Source        struct {
+		URL    string `json:"url,omitempty"`
+		SHA256 string `json:"sha256,omitempty"`
+		Commit string `json:"commit,omitempty"`
+	} `json:"source"`
+	// BuildHost is the os and arch of the machine that built the package
+	BuildHost        string `json:"buildHost,omitempty"`
+	FermenterVersion string `json:"fermenterVersion,omitempty"`
+	BuildTimestamp   string `json:"buildTimestamp,omitempty"`
+}
+
+// writePackageMetadata writes the metadata and the files manifest of t into its package directory before it is archived
+func writePackageMetadata(t *buildTarget) error {
+	metadata := packageMetadata{
+		Name:     t.Package,
+		Arch:     t.targetArch(),
+		OS:       runtime.GOOS,
+		Binaries: packageBinaries(t),
+	}
+	var err error
+	metadata.Dependencies, err = getDependencies(t.Path, t.Package)
+	if err != nil {
+		return err
+	}
+	metadata.Version, err = getBarrellAttribute(t.Package, "version", t.Options.Barrells)
+	if err != nil {
+		return err
+	}
+	revision, err := getBarrellAttribute(t.Package, "revision", t.Options.Barrells)
+	if err != nil {
+		return err
+	}
+	metadata.Revision, _ = strconv.Atoi(revision)
+	for attr, value := range map[string]*string{"description": &metadata.Description, "homepage": &metadata.Homepage, "license": &metadata.License} {
+		*value, err = getBarrellAttribute(t.Package, attr, t.Options.Barrells)
+		if err != nil {
+			return err
+		}
+	}
+	if content, err := os.ReadFile(t.Path); err == nil {
+		sum := sha256.Sum256(content)
+		metadata.BarrellSHA256 = hex.EncodeToString(sum[:])
+	}
+	metadata.Source.URL = t.State.Outputs["sourceURL"]
+	metadata.Source.SHA256 = t.State.Outputs["sourceSHA256"]
+	metadata.Source.Commit = t.State.Outputs["sourceCommit"]
+	//the hostname and the current time would make archives differ between machines and runs
+	metadata.BuildHost = runtime.GOOS + "/" + runtime.GOARCH
+	metadata.FermenterVersion = fermenterVersion()
+	timestamp, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	metadata.BuildTimestamp = timestamp.UTC().Format(time.RFC3339)
+
+	root := workspaceDir(t.Package)
+	dir := filepath.Join(root, metadataDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFilesManifest(root, filepath.Join(dir, filesManifest)); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "metadata.json"), content, 0644)
+}
+
+// packageBinaries returns the binary declared by the barrell of t and the executables in the bin directory of its package
+func packageBinaries(t *buildTarget) []string {
+	var binaries []string
+	if binary := checkIfBinaryRequired(t.Package, t.Options.Barrells); binary != nil && *binary != "" {
+		binaries = append(binaries, filepath.Base(*binary))
+	}
+	entries, _ := os.ReadDir(filepath.Join(workspaceDir(t.Package), "bin"))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		if !containsString(binaries, entry.Name()) {
+			binaries = append(binaries, entry.Name())
+		}
+	}
+	return binaries
+}
+
+// writeFilesManifest lists every file and symlink below root except the metadata directory at path
+// Symlinks are recorded with the sha256 and length of their target so clients can verify them too
+func writeFilesManifest(root string, path string) error {
+	var lines []string
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if file != root && d.Name() == metadataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var sum string
+		size := info.Size()
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			hash := sha256.Sum256([]byte(target))
+			sum, size = hex.EncodeToString(hash[:]), int64(len(target))
+		case info.Mode().IsRegular():
+			sum, err = fileSHA256(file)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", sum, manifestMode(info.Mode()), size, filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return manifestPath(lines[i]) < manifestPath(lines[j])
+	})
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// manifestMode returns the mode recorded in the files manifest, only the bits kept in the archive are written
+// so a mode read back from a tar header compares equal
+func manifestMode(mode fs.FileMode) string {
+	return (mode & (fs.ModeType | fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)).String()
+}
+
+// manifestPath returns the path of a files manifest line, paths may contain spaces
+func manifestPath(line string) string {
+	parts := strings.SplitN(line, " ", 4)
+	return parts[len(parts)-1]
+}
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fermenterVersion reads VERSION.meta next to the fermenter executable
+func fermenterVersion() string {
+	location, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(location), "VERSION.meta"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
@@ -0,0 +1,416 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Statuses of a package in a multi package build
+const (
+	statusBuilt   = "built"
+	statusCached  = "cached"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+)
+
+// multiBuildFlags are only meaningful to the scheduling process and are not passed on to each build
+var multiBuildFlags = []string{"all", "changed-since", "jobs", "status-file", "debug-on-failure", "rdeps"}
+
+// buildResult is the outcome of building a single package
+type buildResult struct {
+	Package  string
+	Status   string
+	Duration time.Duration
+	Log      string
+	Reason   string
+	// Archives are the prebuild archives the build produced, dependents install them
+	Archives []string
+}
+
+// allBarrells returns every package in the barrells directory
+func allBarrells(barrellsLoc string) ([]string, error) {
+	entries, err := os.ReadDir(barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".py") || strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		pkgs = append(pkgs, strings.TrimSuffix(name, ".py"))
+	}
+	return pkgs, nil
+}
+
+// changedBarrells returns the packages whose barrell changed between ref and the working tree
+func changedBarrells(barrellsLoc string, ref string) ([]string, error) {
+	repo, err := git.PlainOpenWithOptions(barrellsLoc, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := filepath.Rel(wt.Filesystem.Root(), abs)
+	if err != nil {
+		return nil, err
+	}
+	from, err := commitTree(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	to, err := commitTree(repo, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, change := range changes {
+		paths = append(paths, change.From.Name, change.To.Name)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, err
+	}
+	for path, s := range status {
+		if s.Worktree != git.Unmodified || s.Staging != git.Unmodified {
+			paths = append(paths, path)
+		}
+	}
+	seen := make(map[string]bool)
+	var pkgs []string
+	for _, path := range paths {
+		if path == "" || filepath.Dir(path) != prefix {
+			continue
+		}
+		name := filepath.Base(path)
+		if !strings.HasSuffix(name, ".py") || strings.HasPrefix(name, "_") {
+			continue
+		}
+		pkg := strings.TrimSuffix(name, ".py")
+		//deleted barrells can not be built
+		if seen[pkg] || !doesExist(fmt.Sprintf("%s/%s.py", barrellsLoc, pkg)) {
+			continue
+		}
+		seen[pkg] = true
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs, nil
+}
+func commitTree(repo *git.Repository, rev string) (*object.Tree, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", rev, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// buildGraph returns the dependency graph of pkgs, only counting dependencies that are being built as well
+func buildGraph(pkgs []string, barrellsLoc string) (*depGraph, error) {
+	graph := newDepGraph()
+	for _, pkg := range pkgs {
+		graph.add(pkg, nil)
+	}
+	for _, pkg := range pkgs {
+		specs, err := dependenciesFor(fmt.Sprintf("%s/%s.py", barrellsLoc, pkg), pkg, buildSets...)
+		if err != nil {
+			return nil, err
+		}
+		var deps []string
+		for _, dep := range specs {
+			name := dependencyPackage(dep)
+			if name != "" && name != pkg && containsString(pkgs, name) {
+				deps = append(deps, name)
+			}
+		}
+		graph.add(pkg, deps)
+	}
+	return graph, nil
+}
+
+// buildMany builds pkgs in dependency order on jobs workers and prints a summary
+// Each package is built by a separate fermenter process so failures can not take down the others
+// Returns the exit code for the whole run
+func buildMany(cmd *cobra.Command, pkgs []string, barrellsLoc string, jobs int) int {
+	for _, pkg := range pkgs {
+		if !doesExist(fmt.Sprintf("%s/%s.py", barrellsLoc, pkg)) {
+			color.Red("ERROR: Package %s not found in %s\n", pkg, barrellsLoc)
+			return 1
+		}
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	color.Yellow("Resolving dependencies of %d packages", len(pkgs))
+	graph, err := buildGraph(pkgs, barrellsLoc)
+	if err != nil {
+		color.Red("ERROR: %s", err)
+		return 1
+	}
+	order, err := graph.topoOrder()
+	if err != nil {
+		color.Red("ERROR: %s", err)
+		return 1
+	}
+	color.Green("Build order: %s", strings.Join(order, ", "))
+	flags := forwardedFlags(cmd)
+	//dependents install the archives of freshly built dependencies instead of the ones on the server
+	artifactDir, err := siblingArtifactDir(cmd)
+	if err != nil {
+		color.Red("ERROR: %s", err)
+		return 1
+	}
+	if artifactDir != "" {
+		defer os.RemoveAll(artifactDir)
+		flags = append(flags, "--deps-from="+artifactDir)
+	}
+	results := scheduleBuilds(graph, order, jobs, func(pkg string) buildResult {
+		r := runChildBuild(pkg, flags)
+		if artifactDir != "" {
+			for _, archive := range r.Archives {
+				target := filepath.Join(artifactDir, filepath.Base(archive))
+				os.Remove(target)
+				if err := os.Symlink(archive, target); err != nil {
+					color.Yellow("WARNING: %s", err)
+				}
+			}
+		}
+		return r
+	})
+	printBuildSummary(order, results)
+	for _, r := range results {
+		if r.Status == statusFailed || r.Status == statusSkipped {
+			return 1
+		}
+	}
+	return 0
+}
+
+// siblingArtifactDir creates the directory the archives of the packages built so far are linked into
+// Archives from --deps-from are linked into it as well, with --deps-from-source there is none
+func siblingArtifactDir(cmd *cobra.Command) (string, error) {
+	deps, err := readDependencySource(cmd)
+	if err != nil {
+		return "", err
+	}
+	if deps.FromSource {
+		return "", nil
+	}
+	dir, err := os.MkdirTemp("", "fermenter-artifacts-")
+	if err != nil {
+		return "", err
+	}
+	if deps.ArtifactDir == "" {
+		return dir, nil
+	}
+	entries, err := os.ReadDir(deps.ArtifactDir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	for _, entry := range entries {
+		source, err := filepath.Abs(filepath.Join(deps.ArtifactDir, entry.Name()))
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		if err := os.Symlink(source, filepath.Join(dir, entry.Name())); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// forwardedFlags returns the flags set on cmd that every single package build should receive
+func forwardedFlags(cmd *cobra.Command) []string {
+	var flags []string
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		//--deps-from is replaced by the directory holding the archives built in this run
+		if containsString(multiBuildFlags, f.Name) || f.Name == "deps-from" {
+			return
+		}
+		flags = append(flags, fmt.Sprintf("--%s=%s", f.Name, f.Value.String()))
+	})
+	return flags
+}
+
+// scheduleBuilds runs build for every package once all of its dependencies were built
+// Packages depending on a failed or skipped package are skipped
+func scheduleBuilds(graph *depGraph, order []string, jobs int, build func(pkg string) buildResult) map[string]buildResult {
+	results := make(map[string]buildResult)
+	pending := make(map[string]int)
+	for pkg, deps := range graph.deps {
+		pending[pkg] = len(deps)
+	}
+	rev := graph.dependents()
+	var ready []string
+	for _, pkg := range order {
+		if pending[pkg] == 0 {
+			ready = append(ready, pkg)
+		}
+	}
+	finished := make(chan buildResult)
+	running := 0
+	complete := func(r buildResult) {
+		results[r.Package] = r
+		for _, dependent := range rev[r.Package] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	for len(results) < len(order) {
+		for running < jobs && len(ready) > 0 {
+			pkg := ready[0]
+			ready = ready[1:]
+			if failed := failedDependency(graph.deps[pkg], results); failed != "" {
+				color.Yellow("[%s] skipped, %s did not build", pkg, failed)
+				complete(buildResult{Package: pkg, Status: statusSkipped, Reason: failed + " did not build"})
+				continue
+			}
+			running++
+			color.Yellow("[%s] building", pkg)
+			go func(pkg string) {
+				finished <- build(pkg)
+			}(pkg)
+		}
+		if running == 0 {
+			if len(ready) == 0 {
+				break
+			}
+			continue
+		}
+		r := <-finished
+		running--
+		switch r.Status {
+		case statusFailed:
+			color.Red("[%s] failed after %s, see %s", r.Package, r.Duration.Round(time.Second), r.Log)
+		default:
+			color.Green("[%s] %s in %s", r.Package, r.Status, r.Duration.Round(time.Second))
+		}
+		complete(r)
+	}
+	return results
+}
+func failedDependency(deps []string, results map[string]buildResult) string {
+	for _, dep := range deps {
+		if r := results[dep]; r.Status == statusFailed || r.Status == statusSkipped {
+			return dep
+		}
+	}
+	return ""
+}
+
+// runChildBuild builds pkg in a separate fermenter process with its output in a log file
+func runChildBuild(pkg string, flags []string) (result buildResult) {
+	result = buildResult{Package: pkg, Status: statusFailed, Log: fmt.Sprintf("/tmp/fermenter-build-%s.log", pkg)}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+	executable, err := os.Executable()
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	statusFile, err := os.CreateTemp("", "fermenter-status-")
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	statusFile.Close()
+	defer os.Remove(statusFile.Name())
+	logFile, err := os.Create(result.Log)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	defer logFile.Close()
+	args := append([]string{"build", pkg, "--status-file=" + statusFile.Name()}, flags...)
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	status, err := os.ReadFile(statusFile.Name())
+	if err != nil || len(status) == 0 {
+		result.Status = statusBuilt
+		return result
+	}
+	lines := strings.Split(strings.TrimSpace(string(status)), "\n")
+	result.Status = lines[0]
+	result.Archives = lines[1:]
+	return result
+}
+
+// buildStatus returns the status of a single package build
+func buildStatus(cached bool) string {
+	if cached {
+		return statusCached
+	}
+	return statusBuilt
+}
+
+// writeBuildStatus records the outcome of a single package build and its archives for the scheduling process
+func writeBuildStatus(cmd *cobra.Command, status string, archives []string) {
+	path, err := cmd.Flags().GetString("status-file")
+	if err != nil || path == "" {
+		return
+	}
+	os.WriteFile(path, []byte(strings.Join(append([]string{status}, archives...), "\n")), 0644)
+}
+func printBuildSummary(order []string, results map[string]buildResult) {
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nPACKAGE\tSTATUS\tTIME\tDETAILS")
+	for _, pkg := range order {
+		r := results[pkg]
+		counts[r.Status]++
+		details := r.Reason
+		if r.Status == statusFailed {
+			details = r.Log
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pkg, r.Status, r.Duration.Round(time.Second), details)
+	}
+	w.Flush()
+	fmt.Printf("%s, %s, %s, %s\n",
+		color.GreenString("%d built", counts[statusBuilt]),
+		color.GreenString("%d cached", counts[statusCached]),
+		color.YellowString("%d skipped", counts[statusSkipped]),
+		color.RedString("%d failed", counts[statusFailed]))
+}
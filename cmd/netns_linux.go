@@ -0,0 +1,42 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// capNetAdmin lets the build bring up loopback inside its own network namespace
+const capNetAdmin = 12
+
+// isolateNetwork makes cmd start in a new network namespace that only has loopback
+// Without root a user namespace mapping the current user is created alongside it
+func isolateNetwork(cmd *exec.Cmd) error {
+	attr := &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	if uid := os.Geteuid(); uid != 0 {
+		gid := os.Getegid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.AmbientCaps = []uintptr{capNetAdmin}
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// isolatedPythonCommand runs code in a new network namespace
+// sudo is only used when the prefix is not writable, otherwise the current user is mapped to root in a user namespace
+func isolatedPythonCommand(code string) (*exec.Cmd, error) {
+	args := []string{"unshare", "--net", "--", "python3", "-c", networkPreamble(false) + code}
+	if os.Geteuid() == 0 {
+		return exec.Command(args[0], args[1:]...), nil
+	}
+	if prefixWritable() {
+		return exec.Command("unshare", append([]string{"--map-root-user"}, args[1:]...)...), nil
+	}
+	return exec.Command("sudo", args...), nil
+}
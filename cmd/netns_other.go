@@ -0,0 +1,20 @@
+//go:build !linux
+
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errNoNetworkNamespace = errors.New("hermetic builds need network namespaces, which are only available on linux")
+
+func isolateNetwork(cmd *exec.Cmd) error {
+	return errNoNetworkNamespace
+}
+func isolatedPythonCommand(code string) (*exec.Cmd, error) {
+	return nil, errNoNetworkNamespace
+}
@@ -0,0 +1,691 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/go-git/go-git/v5"
+	"github.com/spf13/cobra"
+)
+
+// Phase statuses persisted in the workspace
+const (
+	phaseRunning = "running"
+	phaseDone    = "done"
+	phaseCached  = "cached"
+	phaseFailed  = "failed"
+	phaseSkipped = "skipped"
+)
+
+// buildPhase is a single step of the build pipeline
+// Needs lists the outputs of earlier phases it reads, Produces the outputs it records
+type buildPhase struct {
+	Name     string
+	Needs    []string
+	Produces []string
+	Run      func(t *buildTarget) error
+}
+
+// phaseRecord is the persisted result of a phase
+type phaseRecord struct {
+	Status string    `json:"status"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	// Processes holds the exit code and resource usage of the builds run by the phase
+	Processes []processUsage `json:"processes,omitempty"`
+}
+
+// buildState is persisted in the workspace after every phase so later runs can resume
+type buildState struct {
+	Package  string                 `json:"package"`
+	Arch     string                 `json:"arch"`
+	CacheKey string                 `json:"cacheKey,omitempty"`
+	Phases   map[string]phaseRecord `json:"phases"`
+	Outputs  map[string]string      `json:"outputs"`
+}
+
+// buildOptions are the build flags shared by every phase
+type buildOptions struct {
+	Barrells          string
+	NoUpload          bool
+	AllowArchMismatch bool
+	StrictLibs        bool
+	RewritePaths      bool
+	StrictPaths       bool
+	SignKey           string
+	ChunkSize         string
+	Report            string
+	MaxMemory         string
+	MaxCPUs           float64
+	MaxPids           int64
+	Hermetic          bool
+	DebugOnFailure    bool
+	CompilerCache     string
+	CacheDir          string
+	Deps              dependencySource
+}
+
+func readBuildOptions(cmd *cobra.Command) (buildOptions, error) {
+	var opts buildOptions
+	var err error
+	opts.Barrells, err = cmd.Flags().GetString("barrells")
+	if err != nil {
+		panic(err)
+	}
+	opts.NoUpload, err = cmd.Flags().GetBool("no-upload")
+	if err != nil {
+		panic(err)
+	}
+	opts.AllowArchMismatch, err = cmd.Flags().GetBool("allow-arch-mismatch")
+	if err != nil {
+		panic(err)
+	}
+	opts.StrictLibs, err = cmd.Flags().GetBool("strict-libs")
+	if err != nil {
+		panic(err)
+	}
+	opts.RewritePaths, err = cmd.Flags().GetBool("rewrite-paths")
+	if err != nil {
+		panic(err)
+	}
+	opts.StrictPaths, err = cmd.Flags().GetBool("strict-paths")
+	if err != nil {
+		panic(err)
+	}
+	opts.SignKey, err = cmd.Flags().GetString("sign-key")
+	if err != nil {
+		panic(err)
+	}
+	opts.ChunkSize, err = cmd.Flags().GetString("chunk-size")
+	if err != nil {
+		panic(err)
+	}
+	opts.Report, err = cmd.Flags().GetString("report")
+	if err != nil {
+		panic(err)
+	}
+	opts.MaxMemory, err = cmd.Flags().GetString("max-memory")
+	if err != nil {
+		panic(err)
+	}
+	opts.MaxCPUs, err = cmd.Flags().GetFloat64("max-cpus")
+	if err != nil {
+		panic(err)
+	}
+	opts.MaxPids, err = cmd.Flags().GetInt64("max-pids")
+	if err != nil {
+		panic(err)
+	}
+	opts.Hermetic, err = cmd.Flags().GetBool("hermetic")
+	if err != nil {
+		panic(err)
+	}
+	opts.DebugOnFailure, err = cmd.Flags().GetBool("debug-on-failure")
+	if err != nil {
+		panic(err)
+	}
+	opts.CompilerCache, err = cmd.Flags().GetString("compiler-cache")
+	if err != nil {
+		panic(err)
+	}
+	opts.CacheDir, err = cmd.Flags().GetString("cache-dir")
+	if err != nil {
+		panic(err)
+	}
+	opts.Deps, err = readDependencySource(cmd)
+	return opts, err
+}
+
+// buildTarget is a package built for a single arch, or for both arches merged into a universal build
+type buildTarget struct {
+	Path      string
+	Package   string
+	Arch      string
+	Universal bool
+	// Root is the workspace root of this target, per arch builds of a universal target live below it
+	Root    string
+	Options buildOptions
+	State   buildState
+	phases  []buildPhase
+	// processes collects the usage of processes run by the current phase
+	processes []processUsage
+}
+
+func newBuildTarget(path string, pkg string, arch string, universal bool, root string, opts buildOptions) *buildTarget {
+	t := &buildTarget{
+		Path:      path,
+		Package:   pkg,
+		Arch:      arch,
+		Universal: universal,
+		Root:      root,
+		Options:   opts,
+		phases:    buildPhases(universal),
+	}
+	t.State = buildState{Package: pkg, Arch: t.archLabel(), Phases: make(map[string]phaseRecord), Outputs: make(map[string]string)}
+	return t
+}
+
+// archLabel returns the arch passed to the barrell
+func (t *buildTarget) archLabel() string {
+	if t.Arch == "" {
+		return "universal"
+	}
+	return t.Arch
+}
+
+// targetArch returns the arch the binaries of t are built for, the host arch for default builds
+func (t *buildTarget) targetArch() string {
+	switch {
+	case t.Universal:
+		return "universal"
+	case t.Arch == "":
+		return runtime.GOARCH
+	}
+	return t.Arch
+}
+func (t *buildTarget) statePath() string {
+	return filepath.Join(t.Root, fmt.Sprintf(".%s-state.json", t.Package))
+}
+func (t *buildTarget) archive() string {
+	return archivePath(t.Package, t.Arch)
+}
+
+// loadState reads the state left by an earlier run, a missing state file is not an error
+func (t *buildTarget) loadState() error {
+	content, err := os.ReadFile(t.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state buildState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("%s: %s", t.statePath(), err)
+	}
+	if state.Phases == nil {
+		state.Phases = make(map[string]phaseRecord)
+	}
+	if state.Outputs == nil {
+		state.Outputs = make(map[string]string)
+	}
+	t.State = state
+	return nil
+}
+func (t *buildTarget) saveState() {
+	content, err := json.MarshalIndent(t.State, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(t.Root, 0777)
+	os.WriteFile(t.statePath(), content, 0644)
+}
+
+// buildPhases returns the pipeline in execution order
+// Universal targets build each arch separately and merge the results, the merged package is installed and compressed
+func buildPhases(universal bool) []buildPhase {
+	output := "build"
+	if universal {
+		output = "merged"
+	}
+	phases := []buildPhase{
+		{Name: "deps", Produces: []string{"dependencies"}, Run: phaseDeps},
+		{Name: "download", Produces: []string{"source"}, Run: phaseDownload},
+		{Name: "build", Needs: []string{"source"}, Produces: []string{"build"}, Run: phaseBuild},
+	}
+	if universal {
+		phases = append(phases, buildPhase{Name: "merge", Needs: []string{"build"}, Produces: []string{"merged"}, Run: phaseMerge})
+	}
+	phases = append(phases, buildPhase{Name: "install", Needs: []string{output}, Produces: []string{"install"}, Run: phaseInstall})
+	return append(phases,
+		buildPhase{Name: "compress", Needs: []string{output}, Produces: []string{"archive"}, Run: phaseCompress},
+		buildPhase{Name: "upload", Needs: []string{"archive"}, Produces: []string{"upload"}, Run: phaseUpload},
+	)
+}
+
+// phaseNames returns the names of every phase a build can have
+func phaseNames() []string {
+	var names []string
+	for _, p := range buildPhases(true) {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// phaseSelection is the inclusive range of phases to run, empty bounds mean the first or last phase
+type phaseSelection struct {
+	From string
+	To   string
+	// UseExisting takes the package directory in the workspace as the build output when no earlier run recorded one
+	UseExisting bool
+}
+
+func readPhaseSelection(cmd *cobra.Command) (phaseSelection, error) {
+	var sel phaseSelection
+	from, err := cmd.Flags().GetString("from")
+	if err != nil {
+		panic(err)
+	}
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		panic(err)
+	}
+	only, err := cmd.Flags().GetString("only")
+	if err != nil {
+		panic(err)
+	}
+	useExisting, err := cmd.Flags().GetBool("use-existing")
+	if err != nil {
+		panic(err)
+	}
+	if only != "" && (from != "" || to != "") {
+		return sel, errors.New("--only can not be combined with --from or --to")
+	}
+	sel = phaseSelection{From: from, To: to}
+	if only != "" {
+		sel = phaseSelection{From: only, To: only}
+	}
+	if useExisting && sel.From == "" {
+		sel.From = "compress"
+	}
+	sel.UseExisting = useExisting
+	for _, name := range []string{sel.From, sel.To} {
+		if name != "" && !containsString(phaseNames(), name) {
+			return sel, fmt.Errorf("unknown phase %s, expected one of %s", name, strings.Join(phaseNames(), ", "))
+		}
+	}
+	return sel, nil
+}
+
+// selected returns the phases of t within sel
+func (t *buildTarget) selected(sel phaseSelection) []buildPhase {
+	start, end := 0, len(t.phases)-1
+	for i, p := range t.phases {
+		if p.Name == sel.From {
+			start = i
+		}
+		if p.Name == sel.To {
+			end = i
+		}
+	}
+	if start > end {
+		return nil
+	}
+	return t.phases[start : end+1]
+}
+
+// hasOutput reports whether an earlier run recorded output and it is still on disk
+func (t *buildTarget) hasOutput(name string) bool {
+	value, ok := t.State.Outputs[name]
+	if !ok {
+		return false
+	}
+	if filepath.IsAbs(value) {
+		return doesExist(value)
+	}
+	return true
+}
+
+// adoptWorkspace records the package directory in the workspace as the output p needs
+// when there is no state from an earlier run, e.g. a package built by hand or by an older fermenter
+func (t *buildTarget) adoptWorkspace(p buildPhase) {
+	dir := workspaceDir(t.Package)
+	if !doesExist(dir) {
+		return
+	}
+	for _, need := range p.Needs {
+		if (need == "build" || need == "merged") && !t.hasOutput(need) {
+			t.State.Outputs[need] = dir
+		}
+	}
+}
+
+// invalidate forgets the outputs of the phase at index and every phase after it
+func (t *buildTarget) invalidate(index int) {
+	for _, p := range t.phases[index:] {
+		for _, out := range p.Produces {
+			delete(t.State.Outputs, out)
+		}
+	}
+}
+
+// runPipeline runs the selected phases of t, reporting whether the archive came from the cache
+// The state is saved after every phase so a failed run can be inspected and resumed
+func runPipeline(t *buildTarget, sel phaseSelection, cache *buildCache) (bool, error) {
+	workspaceRoot = t.Root
+	if err := t.loadState(); err != nil {
+		return false, err
+	}
+	for _, name := range []string{sel.From, sel.To} {
+		if name != "" && phaseIndex(t.phases, name) < 0 {
+			return false, fmt.Errorf("phase %s only exists for --universal builds", name)
+		}
+	}
+	phases := t.selected(sel)
+	if len(phases) == 0 {
+		return false, fmt.Errorf("--from %s comes after --to %s", sel.From, sel.To)
+	}
+	if sel.UseExisting {
+		t.adoptWorkspace(phases[0])
+	}
+	produced := make(map[string]bool)
+	for _, p := range phases {
+		for _, need := range p.Needs {
+			if !produced[need] && !t.hasOutput(need) {
+				return false, fmt.Errorf("phase %s needs the %s output of an earlier phase, run it first or widen --from", p.Name, need)
+			}
+		}
+		for _, out := range p.Produces {
+			produced[out] = true
+		}
+	}
+	cached := false
+	cachedPhases := make(map[string]bool)
+	if cache != nil && phasesInclude(phases, "build", "compress") {
+		key, err := cacheKey(t.Path, t.Package, t.Options, t.targetArch())
+		if err != nil {
+			color.Yellow("WARNING - CACHE: unable to compute cache key, building without cache: %s", err)
+			cache.log.Printf("key error for %s: %s", t.Package, err)
+		} else if cache.fetch(key, t.archive()) {
+			color.Green("Cache hit for %s (%s)", t.Package, key[:12])
+			cached = true
+		} else {
+			color.Yellow("Cache miss for %s (%s)", t.Package, key[:12])
+			cache.log.Printf("miss %s", key)
+		}
+		t.State.CacheKey = key
+		if cached {
+			for _, p := range t.phases {
+				if p.Name != "deps" && p.Name != "upload" {
+					cachedPhases[p.Name] = true
+				}
+			}
+		}
+	}
+	for _, p := range phases {
+		index := phaseIndex(t.phases, p.Name)
+		if cachedPhases[p.Name] {
+			t.State.Phases[p.Name] = phaseRecord{Status: phaseCached, Start: time.Now(), End: time.Now()}
+			if p.Name == "compress" {
+				t.State.Outputs["archive"] = t.archive()
+			}
+			t.saveState()
+			continue
+		}
+		t.invalidate(index)
+		record := phaseRecord{Status: phaseRunning, Start: time.Now()}
+		t.State.Phases[p.Name] = record
+		t.saveState()
+		t.processes = nil
+		err := p.Run(t)
+		record.End = time.Now()
+		record.Processes = t.processes
+		switch {
+		case errors.Is(err, errPhaseSkipped):
+			record.Status = phaseSkipped
+		case err != nil:
+			record.Status = phaseFailed
+			record.Error = err.Error()
+			t.State.Phases[p.Name] = record
+			t.saveState()
+			return cached, fmt.Errorf("%s: %s", p.Name, err)
+		default:
+			record.Status = phaseDone
+		}
+		t.State.Phases[p.Name] = record
+		t.saveState()
+		if p.Name == "compress" && cache != nil && t.State.CacheKey != "" {
+			cache.store(t.State.CacheKey, t.archive())
+		}
+	}
+	return cached, nil
+}
+func phasesInclude(phases []buildPhase, names ...string) bool {
+	for _, name := range names {
+		if phaseIndex(phases, name) < 0 {
+			return false
+		}
+	}
+	return true
+}
+func phaseIndex(phases []buildPhase, name string) int {
+	for i, p := range phases {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// errPhaseSkipped is returned by a phase that had nothing to do
+var errPhaseSkipped = errors.New("skipped")
+
+// forEachArch runs fn with the workspace root of every arch the target is built for
+func (t *buildTarget) forEachArch(fn func(arch string) error) error {
+	defer func() {
+		workspaceRoot = t.Root
+	}()
+	if !t.Universal {
+		workspaceRoot = t.Root
+		return fn(t.Arch)
+	}
+	for _, arch := range []string{"amd64", "arm64"} {
+		fmt.Println("Building for arch:", arch)
+		workspaceRoot = filepath.Join(t.Root, arch)
+		if err := fn(arch); err != nil {
+			return fmt.Errorf("%s: %s", arch, err)
+		}
+	}
+	return nil
+}
+
+// watched runs fn while recording files the package places in the prefix
+// The install lock is held throughout so the watcher of a parallel build can not record the files of another package
+func watched(pkg string, fn func() error) error {
+	unlock, err := lockInstalls()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	doneBuilding := make(chan bool)
+	go magicWatcher(pkg, doneBuilding)
+	err = fn()
+	doneBuilding <- true
+	return err
+}
+func phaseDeps(t *buildTarget) error {
+	dep, err := getDependencies(t.Path, t.Package)
+	if err != nil {
+		return err
+	}
+	if err := installDependencyClosure(t.Package, t.Options.Barrells, t.Options.Deps, buildSets...); err != nil {
+		return err
+	}
+	t.State.Outputs["dependencies"] = strings.Join(dep, ",")
+	return nil
+}
+func phaseDownload(t *buildTarget) error {
+	var source string
+	err := t.forEachArch(func(arch string) error {
+		source = workspaceDir(t.Package)
+		if err := os.MkdirAll(workspaceRoot, 0777); err != nil {
+			return err
+		}
+		os.RemoveAll(workspaceDir(t.Package))
+		if !downloadsource(t.Package, t.Options.Barrells) {
+			return errors.New("unable to download source")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.State.Outputs["source"] = source
+	recordSource(t, source)
+	return nil
+}
+
+// recordSource saves the url and commit or checksum of the downloaded source for the build report
+func recordSource(t *buildTarget, source string) {
+	if UsingGit(t.Package, t.Path) {
+		t.State.Outputs["sourceURL"] = strings.TrimSpace(GetGitURL(t.Package, t.Path))
+		if repo, err := git.PlainOpen(source); err == nil {
+			if head, err := repo.Head(); err == nil {
+				t.State.Outputs["sourceCommit"] = head.Hash().String()
+			}
+		}
+		return
+	}
+	url, err := getBarrellAttribute(t.Package, "url", t.Options.Barrells)
+	if err != nil {
+		return
+	}
+	t.State.Outputs["sourceURL"] = url
+	//DownloadFromTar keeps the tarball in /tmp under its original name
+	content, err := os.ReadFile(filepath.Join("/tmp", filepath.Base(url)))
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(content)
+	t.State.Outputs["sourceSHA256"] = hex.EncodeToString(sum[:])
+}
+func phaseBuild(t *buildTarget) error {
+	var build string
+	var err error
+	buildLimits, err = resolveLimits(t.Options, t.Package)
+	if err != nil {
+		return err
+	}
+	err = resolveNetwork(t)
+	if err != nil {
+		return err
+	}
+	err = resolveCompilerCache(t)
+	if err != nil {
+		return err
+	}
+	var before compilerCacheStats
+	if activeCompilerCache != nil {
+		defer os.RemoveAll(activeCompilerCache.wrappers)
+		before, _ = activeCompilerCache.stats()
+	}
+	err = t.forEachArch(func(arch string) error {
+		build = workspaceDir(t.Package)
+		//the build is not watched, files only reach the prefix in the install phase
+		usage, err := runBuildCommand(t.Path, t.Package, arch)
+		usage.Arch = arch
+		usage.Log = buildLogPath(t.Package)
+		t.processes = append(t.processes, usage)
+		t.State.Outputs["log"] = usage.Log
+		if err != nil {
+			suggestions := suggestDependencies(t.Path, t.Package, usage.Log, t.Options.Barrells)
+			t.State.Outputs["suggestions"] = strings.Join(suggestions, "\n")
+			if t.Options.DebugOnFailure {
+				color.Red("ERROR - BUILD: %s", err)
+				if err := debugShell(t.Path, t.Package, arch); err != nil {
+					color.Yellow("WARNING - SHELL: %s", err)
+				}
+			}
+			return err
+		}
+		if err := checkArch(t.Package, arch, t.Options.AllowArchMismatch); err != nil {
+			return err
+		}
+		return checkLibraries(t, t.Options.StrictLibs)
+	})
+	if activeCompilerCache != nil {
+		recordCompilerCacheStats(t, before)
+	}
+	if err != nil {
+		return err
+	}
+	t.State.Outputs["build"] = build
+	return nil
+}
+func phaseInstall(t *buildTarget) error {
+	err := resolveNetwork(t)
+	if err != nil {
+		return err
+	}
+	//universal targets install the merged package in the target root once, not each arch in turn
+	workspaceRoot = t.Root
+	err = watched(t.Package, func() error {
+		return installPKG(t.Package, t.Options.Barrells)
+	})
+	if err != nil {
+		return err
+	}
+	t.State.Outputs["install"] = "done"
+	return nil
+}
+func phaseMerge(t *buildTarget) error {
+	out := workspaceDir(t.Package)
+	amd64Dir := filepath.Join(t.Root, "amd64", t.Package)
+	arm64Dir := filepath.Join(t.Root, "arm64", t.Package)
+	os.RemoveAll(out)
+	fmt.Println("Merging into universal build")
+	problems, err := mergeUniversal(amd64Dir, arm64Dir, out)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		color.Yellow("WARNING - UNIVERSAL: %s", problem)
+	}
+	if err := checkArch(t.Package, "universal", t.Options.AllowArchMismatch); err != nil {
+		return err
+	}
+	t.State.Outputs["merged"] = out
+	return nil
+}
+func phaseCompress(t *buildTarget) error {
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	//paths are rewritten after the local install so pkg.install() still ran in an untouched tree
+	if err := checkRelocatable(t, t.Options.RewritePaths, t.Options.StrictPaths); err != nil {
+		return err
+	}
+	if err := writePackageMetadata(t); err != nil {
+		return err
+	}
+	if err := writeArchive(t.archive(), workspaceRoot, t.Package, epoch); err != nil {
+		return err
+	}
+	t.State.Outputs["archive"] = t.archive()
+	return signIfRequested(t)
+}
+func phaseUpload(t *buildTarget) error {
+	if t.Options.NoUpload {
+		return errPhaseSkipped
+	}
+	chunkSize, err := parseByteSize(t.Options.ChunkSize)
+	if err != nil {
+		return fmt.Errorf("--chunk-size: %s", err)
+	}
+	if chunkSize <= 0 {
+		return errors.New("--chunk-size must be larger than 0")
+	}
+	//archives restored from the cache were not signed by the compress phase
+	if err := signIfRequested(t); err != nil {
+		return err
+	}
+	file, parts := uploadtoapi(t.archive(), t.Package, t.Arch, chunkSize)
+	t.State.Outputs["upload"] = file
+	t.State.Outputs["parts"] = strconv.Itoa(parts)
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// defaultPrefix is where ferment installs packages unless --prefix is given
+const defaultPrefix = "/usr/local"
+
+// prefixFlag is the value of --prefix, use fermentPrefix to read it
+var prefixFlag = defaultPrefix
+
+// fermentPrefix returns the absolute install prefix, environment variables such as $HOME are expanded
+func fermentPrefix() string {
+	prefix := os.ExpandEnv(prefixFlag)
+	if abs, err := filepath.Abs(prefix); err == nil {
+		prefix = abs
+	}
+	return prefix
+}
+
+// prefixPath joins elem to the install prefix
+func prefixPath(elem ...string) string {
+	return filepath.Join(append([]string{fermentPrefix()}, elem...)...)
+}
+
+// installedDir holds a receipt directory for every package installed by ferment
+func installedDir() string {
+	return prefixPath("ferment", "Installed")
+}
+
+// installLockPath is the lock file lockInstalls takes for the prefix, outside of it since it may need sudo
+func installLockPath() string {
+	sum := sha256.Sum256([]byte(fermentPrefix()))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("fermenter-install-%x.lock", sum[:6]))
+}
+
+// writablePrefixes caches prefixWritable by prefix, it is asked before every python call
+var writablePrefixes = make(map[string]bool)
+
+// prefixWritable reports whether the current user can install into the prefix without sudo
+// A prefix that does not exist yet is checked through its nearest existing parent, nothing is created
+func prefixWritable() bool {
+	prefix := fermentPrefix()
+	if writable, ok := writablePrefixes[prefix]; ok {
+		return writable
+	}
+	writable := os.Geteuid() == 0 || dirWritable(prefix)
+	writablePrefixes[prefix] = writable
+	return writable
+}
+func dirWritable(dir string) bool {
+	for !doesExist(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+	probe, err := os.CreateTemp(dir, ".fermenter-")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
+
+// pythonCommand runs python3 with args, through sudo when the prefix is not writable by the current user
+func pythonCommand(args ...string) *exec.Cmd {
+	if prefixWritable() {
+		return exec.Command("python3", args...)
+	}
+	return exec.Command("sudo", append([]string{"python3"}, args...)...)
+}
+
+// prefixAssignment sets pkg.prefix in the python code driving a barrell
+func prefixAssignment() string {
+	return fmt.Sprintf("pkg.prefix='%s'", fermentPrefix())
+}
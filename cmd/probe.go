@@ -0,0 +1,221 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// dependencyProbe checks whether a dependency is already present on the system
+type dependencyProbe interface {
+	// probe reports whether the dependency was found and its version when it can be told
+	probe() (string, bool)
+	String() string
+}
+
+// probeKinds creates a probe from the argument of a kind:argument probe declaration
+// Barrells declare probes per dependency, e.g. self.probes = {"openssl": ["pkg-config:openssl", "header:openssl/ssl.h"]}
+var probeKinds = map[string]func(arg string) dependencyProbe{
+	"command":    func(arg string) dependencyProbe { return commandProbe(arg) },
+	"pkg-config": func(arg string) dependencyProbe { return pkgConfigProbe(arg) },
+	"library":    func(arg string) dependencyProbe { return libraryProbe(arg) },
+	"header":     func(arg string) dependencyProbe { return headerProbe(arg) },
+	"receipt":    func(arg string) dependencyProbe { return receiptProbe(arg) },
+}
+
+func parseProbe(declaration string) (dependencyProbe, error) {
+	parts := strings.SplitN(declaration, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid probe %q, use kind:argument", declaration)
+	}
+	kind, ok := probeKinds[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown probe kind %s in %q", parts[0], declaration)
+	}
+	return kind(parts[1]), nil
+}
+
+// probesFor returns the probes declared for d, or the ferment receipt and the command of d when none are
+func probesFor(d depSpec, declared []string) ([]dependencyProbe, error) {
+	if len(declared) == 0 {
+		return []dependencyProbe{receiptProbe(d.Package), commandProbe(d.Command)}, nil
+	}
+	var probes []dependencyProbe
+	for _, declaration := range declared {
+		p, err := parseProbe(declaration)
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+// runProbes reports whether any of probes finds the dependency
+// The version is taken from the first probe that finds it with a version
+func runProbes(probes []dependencyProbe) (string, bool) {
+	found := false
+	for _, p := range probes {
+		version, ok := p.probe()
+		if !ok {
+			continue
+		}
+		found = true
+		if version != "" {
+			return version, true
+		}
+	}
+	return "", found
+}
+
+// getBarrellProbes returns the probes attribute of the barrell of pkg by dependency
+func getBarrellProbes(pkg string, barrellsLoc string) (map[string][]string, error) {
+	out, err := executeQuickPython(fmt.Sprintf("import json;from %s import %s;pkg=%s();p=getattr(pkg,'probes',{});print(json.dumps({k:(v if isinstance(v,list) else [v]) for k,v in p.items()}))", pkg, pkg, pkg), barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	probes := make(map[string][]string)
+	if err := json.Unmarshal([]byte(out), &probes); err != nil {
+		return nil, fmt.Errorf("probes of %s: %s", pkg, err)
+	}
+	result := make(map[string][]string)
+	for dep, declared := range probes {
+		result[dependencyPackage(dep)] = declared
+	}
+	return result, nil
+}
+
+// commandProbe finds a command on PATH and asks it for its --version
+type commandProbe string
+
+func (p commandProbe) probe() (string, bool) {
+	path, err := exec.LookPath(string(p))
+	if err != nil {
+		return "", false
+	}
+	out, _ := exec.Command(path, "--version").CombinedOutput()
+	return versionPattern.FindString(string(out)), true
+}
+func (p commandProbe) String() string {
+	return "command:" + string(p)
+}
+
+// pkgConfigProbe checks a pkg-config module with pkg-config --exists
+type pkgConfigProbe string
+
+func (p pkgConfigProbe) probe() (string, bool) {
+	if exec.Command("pkg-config", "--exists", string(p)).Run() != nil {
+		return "", false
+	}
+	out, _ := exec.Command("pkg-config", "--modversion", string(p)).Output()
+	return strings.TrimSpace(string(out)), true
+}
+func (p pkgConfigProbe) String() string {
+	return "pkg-config:" + string(p)
+}
+
+// libraryProbe finds a shared library such as z, libz or libz.so in the ld.so cache or the library search path
+type libraryProbe string
+
+// librarySuffix matches the shared library extension and version of a file name
+var librarySuffix = regexp.MustCompile(`\.(so|dylib|tbd)(\.[\d.]+)?$`)
+
+func (p libraryProbe) name() string {
+	name := librarySuffix.ReplaceAllString(string(p), "")
+	return "lib" + strings.TrimPrefix(name, "lib")
+}
+func (p libraryProbe) probe() (string, bool) {
+	name := p.name()
+	if out, err := exec.Command("ldconfig", "-p").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && strings.HasPrefix(fields[0], name+".so") {
+				return libraryVersion(name, fields[len(fields)-1]), true
+			}
+		}
+	}
+	for _, dir := range librarySearchPath() {
+		matches, _ := filepath.Glob(filepath.Join(dir, name+".*"))
+		for _, match := range matches {
+			if librarySuffix.MatchString(filepath.Base(match)) {
+				return libraryVersion(name, match), true
+			}
+		}
+	}
+	return "", false
+}
+func (p libraryProbe) String() string {
+	return "library:" + string(p)
+}
+
+// libraryVersion reads the version from a library file name such as libz.so.1.2.13, following symlinks
+func libraryVersion(name string, path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	base := strings.TrimPrefix(filepath.Base(path), name)
+	base = strings.TrimPrefix(strings.TrimPrefix(base, ".so"), ".")
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".dylib"), ".tbd")
+	return versionPattern.FindString(base)
+}
+func librarySearchPath() []string {
+	var dirs []string
+	for _, env := range []string{"LD_LIBRARY_PATH", "DYLD_LIBRARY_PATH", "LIBRARY_PATH"} {
+		dirs = append(dirs, filepath.SplitList(os.Getenv(env))...)
+	}
+	dirs = append(dirs, prefixPath("lib"), "/usr/local/lib", "/usr/lib", "/lib", "/usr/lib64", "/lib64")
+	if runtime.GOOS == "darwin" {
+		dirs = append(dirs, "/opt/homebrew/lib")
+	} else {
+		dirs = append(dirs, "/usr/lib/x86_64-linux-gnu", "/usr/lib/aarch64-linux-gnu", "/lib/x86_64-linux-gnu", "/lib/aarch64-linux-gnu")
+	}
+	return dirs
+}
+
+// headerProbe finds a header such as openssl/ssl.h in the include search path
+type headerProbe string
+
+func (p headerProbe) probe() (string, bool) {
+	var dirs []string
+	for _, env := range []string{"CPATH", "C_INCLUDE_PATH", "CPLUS_INCLUDE_PATH"} {
+		dirs = append(dirs, filepath.SplitList(os.Getenv(env))...)
+	}
+	dirs = append(dirs, prefixPath("include"), "/usr/local/include", "/usr/include")
+	if runtime.GOOS == "darwin" {
+		dirs = append(dirs, "/opt/homebrew/include")
+		if sdk, err := exec.Command("xcrun", "--show-sdk-path").Output(); err == nil {
+			dirs = append(dirs, filepath.Join(strings.TrimSpace(string(sdk)), "usr", "include"))
+		}
+	}
+	for _, dir := range dirs {
+		if dir != "" && doesExist(filepath.Join(dir, string(p))) {
+			return "", true
+		}
+	}
+	return "", false
+}
+func (p headerProbe) String() string {
+	return "header:" + string(p)
+}
+
+// receiptProbe checks for a ferment receipt in the Installed directory of the prefix
+type receiptProbe string
+
+func (p receiptProbe) probe() (string, bool) {
+	receipt := filepath.Join(installedDir(), convertToReadableString(strings.ToLower(string(p))))
+	if _, err := os.Stat(receipt); err != nil {
+		return "", false
+	}
+	return receiptVersion(receipt), true
+}
+func (p receiptProbe) String() string {
+	return "receipt:" + string(p)
+}
@@ -0,0 +1,350 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// reverseDependency is a package that depends on another one, directly or through Via
+type reverseDependency struct {
+	Package string `json:"package"`
+	Direct  bool   `json:"direct"`
+	// Via is the chain of packages leading to the queried one, empty for direct dependents
+	Via []string `json:"via,omitempty"`
+	// Links is set by the link check, yes when a binary of Package needs a library of the queried package
+	Links string `json:"links,omitempty"`
+}
+
+// reverseDependencies finds every package in barrellsLoc that needs pkg to build or run
+// Dependents are ordered by distance, then by name
+func reverseDependencies(pkg string, barrellsLoc string) ([]reverseDependency, error) {
+	pkgs, err := allBarrells(barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	graph, err := buildGraph(pkgs, barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	rev := graph.dependents()
+	var result []reverseDependency
+	via := map[string][]string{pkg: nil}
+	queue := []string{pkg}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		dependents := append([]string{}, rev[current]...)
+		sort.Strings(dependents)
+		for _, dependent := range dependents {
+			if _, seen := via[dependent]; seen {
+				continue
+			}
+			chain := via[current]
+			if current != pkg {
+				chain = append(append([]string{}, chain...), current)
+			}
+			via[dependent] = chain
+			result = append(result, reverseDependency{Package: dependent, Direct: current == pkg, Via: chain})
+			queue = append(queue, dependent)
+		}
+	}
+	return result, nil
+}
+
+// withReverseDependencies returns pkg followed by every package depending on it
+func withReverseDependencies(pkg string, barrellsLoc string) ([]string, error) {
+	rdeps, err := reverseDependencies(pkg, barrellsLoc)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []string{pkg}
+	for _, r := range rdeps {
+		pkgs = append(pkgs, r.Package)
+	}
+	return pkgs, nil
+}
+
+// rdepsCmd represents the rdeps command
+var rdepsCmd = &cobra.Command{
+	Use:   "rdeps <package>",
+	Short: "List the packages that depend on a package",
+	Long: `Scans the barrells directory for packages that depend on a package directly or through other
+packages. With --check-links the prebuild archives in a directory are read to confirm that the
+dependents actually link against a library of the package`,
+	Run: func(cmd *cobra.Command, args []string) {
+		barrellsLoc, err := cmd.Flags().GetString("barrells")
+		if err != nil {
+			panic(err)
+		}
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			panic(err)
+		}
+		directOnly, err := cmd.Flags().GetBool("direct")
+		if err != nil {
+			panic(err)
+		}
+		artifacts, err := cmd.Flags().GetString("check-links")
+		if err != nil {
+			panic(err)
+		}
+		if dir, err := isDir(barrellsLoc); err != nil || !dir {
+			color.Red("ERROR: Barrells location is not a directory or does not exist")
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			color.Red("ERROR: Please specify a package")
+			os.Exit(1)
+		}
+		pkg := convertToReadableString(strings.ToLower(args[0]))
+		if !doesExist(barrellPath(pkg, barrellsLoc)) {
+			color.Red("ERROR: Package not found in %s\n", barrellsLoc)
+			os.Exit(1)
+		}
+		rdeps, err := reverseDependencies(pkg, barrellsLoc)
+		if err != nil {
+			color.Red("ERROR - RDEPS: %s", err)
+			os.Exit(1)
+		}
+		if directOnly {
+			var direct []reverseDependency
+			for _, r := range rdeps {
+				if r.Direct {
+					direct = append(direct, r)
+				}
+			}
+			rdeps = direct
+		}
+		if artifacts != "" {
+			if err := checkLinks(pkg, rdeps, artifacts); err != nil {
+				color.Red("ERROR - RDEPS: %s", err)
+				os.Exit(1)
+			}
+		}
+		if asJSON {
+			content, err := json.MarshalIndent(rdeps, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println(string(content))
+			return
+		}
+		if len(rdeps) == 0 {
+			color.Yellow("Nothing depends on %s", pkg)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, r := range rdeps {
+			kind := "direct"
+			if !r.Direct {
+				kind = "via " + strings.Join(r.Via, " -> ")
+			}
+			if r.Links != "" {
+				fmt.Fprintf(w, "%s\t%s\tlinks: %s\n", r.Package, kind, r.Links)
+			} else {
+				fmt.Fprintf(w, "%s\t%s\n", r.Package, kind)
+			}
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rdepsCmd)
+	location, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	location = location[:len(location)-len("/fermenter")]
+	rdepsCmd.Flags().String("barrells", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
+	rdepsCmd.Flags().Bool("json", false, "Print the reverse dependencies as JSON")
+	rdepsCmd.Flags().Bool("direct", false, "Only list direct reverse dependencies")
+	rdepsCmd.Flags().String("check-links", "", "Directory of prebuild archives to check the dependents' linked libraries against")
+}
+
+// checkLinks sets Links on every dependent with a prebuild archive in dir
+// A dependent links against pkg when one of its binaries needs a library file listed in the files manifest of pkg
+func checkLinks(pkg string, rdeps []reverseDependency, dir string) error {
+	manifest, err := packageManifest(pkg, dir)
+	if err != nil {
+		return err
+	}
+	provided := manifestLibraries(manifest)
+	for i := range rdeps {
+		dependentArchive := findPrebuild(rdeps[i].Package, dir)
+		if dependentArchive == "" {
+			rdeps[i].Links = "no prebuild"
+			continue
+		}
+		dependentManifest, err := packageManifest(rdeps[i].Package, dir)
+		if err != nil {
+			return err
+		}
+		needed, err := neededLibraries(dependentArchive, dependentManifest)
+		if err != nil {
+			return err
+		}
+		rdeps[i].Links = "no"
+		for lib := range needed {
+			if provided[lib] {
+				rdeps[i].Links = "yes"
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// findPrebuild returns the archive of pkg for this arch or for all arches in dir
+func findPrebuild(pkg string, dir string) string {
+	for _, name := range []string{fmt.Sprintf("%s-%s.tar.gz", pkg, runtime.GOARCH), pkg + ".tar.gz"} {
+		if doesExist(filepath.Join(dir, name)) {
+			return filepath.Join(dir, name)
+		}
+	}
+	return ""
+}
+
+// packageManifest returns the files manifest lines of pkg from its ferment receipt
+// or, when it is not installed, from its prebuild archive in dir
+func packageManifest(pkg string, dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(installedDir(), pkg, metadataDir, filesManifest))
+	if err != nil {
+		archive := findPrebuild(pkg, dir)
+		if archive == "" {
+			return nil, fmt.Errorf("no prebuild archive for %s in %s", pkg, dir)
+		}
+		content, err = archiveManifest(archive)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// archiveManifest reads the files manifest out of a prebuild archive without unpacking the rest of it
+func archiveManifest(archive string) ([]byte, error) {
+	root, err := archiveRoot(archive)
+	if err != nil {
+		return nil, err
+	}
+	return archiveEntryContent(archive, path.Join(root, metadataDir, filesManifest))
+}
+
+// manifestLibraries returns the base names of the shared libraries in a files manifest, symlinks included
+func manifestLibraries(manifest []string) map[string]bool {
+	libs := make(map[string]bool)
+	for _, line := range manifest {
+		if base := path.Base(manifestPath(line)); librarySuffix.MatchString(base) {
+			libs[base] = true
+		}
+	}
+	return libs
+}
+
+// neededLibraries returns the base names of the libraries needed by the binaries of a prebuild archive
+// Only the executables and libraries listed in its files manifest are read
+func neededLibraries(archive string, manifest []string) (map[string]bool, error) {
+	candidates := make(map[string]bool)
+	for _, line := range manifest {
+		parts := strings.SplitN(line, " ", 4)
+		if len(parts) < 4 || !strings.HasPrefix(parts[1], "-") {
+			continue
+		}
+		if strings.Contains(parts[1], "x") || librarySuffix.MatchString(path.Base(parts[3])) {
+			candidates[parts[3]] = true
+		}
+	}
+	root, err := archiveRoot(archive)
+	if err != nil {
+		return nil, err
+	}
+	needed := make(map[string]bool)
+	err = walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), root+"/")
+		if hdr.Typeflag != tar.TypeReg || !candidates[name] {
+			return nil
+		}
+		//only binaries are read into memory
+		magic := make([]byte, 4)
+		if n, _ := io.ReadFull(r, magic); n < 4 || !isBinaryMagic(magic) {
+			return nil
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		for _, lib := range importedLibraries(append(magic, rest...)) {
+			needed[path.Base(lib)] = true
+		}
+		return nil
+	})
+	return needed, err
+}
+
+// importedLibraries returns DT_NEEDED of an ELF file or LC_LOAD_DYLIB of a Mach-O file
+func importedLibraries(content []byte) []string {
+	if bytes.HasPrefix(content, []byte(elfMagic)) {
+		f, err := elf.NewFile(bytes.NewReader(content))
+		if err != nil {
+			return nil
+		}
+		libs, _ := f.ImportedLibraries()
+		return libs
+	}
+	if f, err := macho.NewFile(bytes.NewReader(content)); err == nil {
+		libs, _ := f.ImportedLibraries()
+		return libs
+	}
+	fat, err := macho.NewFatFile(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	var libs []string
+	for _, arch := range fat.Arches {
+		imported, _ := arch.ImportedLibraries()
+		for _, lib := range imported {
+			if !containsString(libs, lib) {
+				libs = append(libs, lib)
+			}
+		}
+	}
+	return libs
+}
+
+// isBinaryMagic reports whether magic starts an ELF or Mach-O file
+func isBinaryMagic(magic []byte) bool {
+	if string(magic) == elfMagic {
+		return true
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case machoMagic32, machoMagic64, machoCigam32, machoCigam64, machoFatMagic:
+		return true
+	}
+	return false
+}
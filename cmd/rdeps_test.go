@@ -0,0 +1,30 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"testing"
+)
+
+func TestManifestLibraries(t *testing.T) {
+	manifest := []string{
+		"aaaa -rwxr-xr-x 10 bin/tool",
+		"bbbb -rwxr-xr-x 20 lib/libfoo.so.1.2.3",
+		"cccc Lrwxrwxrwx 14 lib/libfoo.so.1",
+		"dddd Lrwxrwxrwx 14 lib/libfoo.so",
+		"eeee -rw-r--r-- 30 lib/libfoo.a",
+		"ffff -rw-r--r-- 40 share/doc/my libbar.dylib",
+	}
+	libs := manifestLibraries(manifest)
+	for _, want := range []string{"libfoo.so.1.2.3", "libfoo.so.1", "libfoo.so", "my libbar.dylib"} {
+		if !libs[want] {
+			t.Errorf("manifestLibraries() is missing %s", want)
+		}
+	}
+	for _, unwanted := range []string{"tool", "libfoo.a"} {
+		if libs[unwanted] {
+			t.Errorf("manifestLibraries() lists %s", unwanted)
+		}
+	}
+}
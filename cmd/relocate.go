@@ -0,0 +1,273 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// textSniffLength is how much of a file is checked for NUL bytes to tell text from binary files
+const textSniffLength = 8000
+
+// buildSystemDirs and buildSystemFiles hold the build directory by design, they are only read by the build system
+// when pkg.install() runs from the unpacked archive so they are neither reported nor rewritten
+var buildSystemDirs = []string{".git", metadataDir, "CMakeFiles", ".deps", "autom4te.cache"}
+var buildSystemFiles = []string{
+	".ferment-watcher", "Makefile", "GNUmakefile", "config.status", "config.log", "config.cache", "libtool",
+	"CMakeCache.txt", "cmake_install.cmake", "CTestTestfile.cmake", "install_manifest.txt", "compile_commands.json",
+	"build.ninja", ".ninja_log", ".ninja_deps", "*.o", "*.lo", "*.la", "*.d", "*.Po", "*.Plo",
+}
+
+// buildSystemFile reports whether name is bookkeeping of the build system, see buildSystemFiles
+func buildSystemFile(name string) bool {
+	for _, pattern := range buildSystemFiles {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathHit is a build path found in a file of the package
+type pathHit struct {
+	File    string `json:"file"`
+	Offset  int    `json:"offset"`
+	Path    string `json:"path"`
+	Context string `json:"context"`
+	Binary  bool   `json:"binary"`
+	Symlink bool   `json:"symlink,omitempty"`
+	// Rewritten is set once the path was replaced with the install prefix
+	Rewritten bool `json:"rewritten"`
+}
+
+func (h pathHit) String() string {
+	kind := "text"
+	switch {
+	case h.Binary:
+		kind = "binary"
+	case h.Symlink:
+		kind = "symlink"
+	}
+	return fmt.Sprintf("%s:%d (%s): %s in %q", h.File, h.Offset, kind, h.Path, h.Context)
+}
+
+// installPrefix is where ferment installs the prebuild of pkg, build paths are rewritten to it
+func installPrefix(pkg string) string {
+	return filepath.Join(installedDir(), pkg)
+}
+
+// buildPathPattern matches the workspace and staging roots of t followed by the package directory below them
+// The roots are tried longest first so the dependency and per arch roots win over the workspace root holding them
+// A root has to end in a slash, the end of the text or a character that can not be part of a path name
+// so /tmp/fermenter.log is not taken for the workspace /tmp/fermenter, that character is captured as
+// the second group since RE2 has no lookahead, use buildPathSpans for the span of the path itself
+func buildPathPattern(t *buildTarget) *regexp.Regexp {
+	var roots []string
+	candidates := []string{t.Root, workspaceRoot, filepath.Join(t.Root, "deps")}
+	if t.Universal {
+		candidates = append(candidates, filepath.Join(t.Root, "amd64"), filepath.Join(t.Root, "arm64"))
+	}
+	for _, root := range candidates {
+		if root != "" && !containsString(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return len(roots[i]) > len(roots[j]) })
+	for i, root := range roots {
+		roots[i] = regexp.QuoteMeta(root)
+	}
+	return regexp.MustCompile(`(?:` + strings.Join(roots, "|") + `)(?:/([^/\s\x00"'` + "`" + `:;,()<>]+))?([^A-Za-z0-9._+~@%=-]|$)`)
+}
+
+// buildPathSpans returns the start and end of every build path matched by pattern in content
+// without the character that ended it
+func buildPathSpans(pattern *regexp.Regexp, content []byte) [][2]int {
+	var spans [][2]int
+	for _, loc := range pattern.FindAllSubmatchIndex(content, -1) {
+		spans = append(spans, [2]int{loc[0], loc[4]})
+	}
+	return spans
+}
+
+// scanBuildPaths returns every match of pattern in the files and symlinks below root, build system files are skipped
+func scanBuildPaths(root string, pattern *regexp.Regexp) ([]pathHit, error) {
+	var hits []pathHit
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && containsString(buildSystemDirs, d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if buildSystemFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if spans := buildPathSpans(pattern, []byte(target)); len(spans) > 0 {
+				hits = append(hits, pathHit{File: rel, Path: target[spans[0][0]:spans[0][1]], Context: target, Symlink: true})
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		binary := bytes.IndexByte(content[:minInt(len(content), textSniffLength)], 0) >= 0
+		for _, loc := range buildPathSpans(pattern, content) {
+			hits = append(hits, pathHit{
+				File:    rel,
+				Offset:  loc[0],
+				Path:    string(content[loc[0]:loc[1]]),
+				Context: hitContext(content, loc[0], loc[1], binary),
+				Binary:  binary,
+			})
+		}
+		return nil
+	})
+	return hits, err
+}
+
+// hitContext returns the line around a match in a text file, or the printable string around it in a binary
+func hitContext(content []byte, start int, end int, binary bool) string {
+	const maxContext = 60
+	inContext := func(b byte) bool {
+		if binary {
+			return b >= 0x20 && b < 0x7f
+		}
+		return b != '\n'
+	}
+	from := start
+	for from > 0 && start-from < maxContext && inContext(content[from-1]) {
+		from--
+	}
+	to := end
+	for to < len(content) && to-end < maxContext && inContext(content[to]) {
+		to++
+	}
+	return strings.TrimSpace(string(content[from:to]))
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// relocate replaces the build paths matched by pattern with the install prefix of the package directory they point to
+func relocate(content []byte, pattern *regexp.Regexp) []byte {
+	return pattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		groups := pattern.FindSubmatch(match)
+		prefix := installedDir()
+		if len(groups[1]) > 0 {
+			prefix = installPrefix(string(groups[1]))
+		}
+		//the character ending the path was matched as well, keep it
+		return append([]byte(prefix), groups[2]...)
+	})
+}
+
+// rewriteBuildPaths relocates the text files and symlinks of hits below root and marks them rewritten
+// Binaries are left alone since changing the length of a path would corrupt them
+func rewriteBuildPaths(root string, hits []pathHit, pattern *regexp.Regexp) error {
+	done := make(map[string]bool)
+	for i := range hits {
+		if hits[i].Binary {
+			continue
+		}
+		if !done[hits[i].File] {
+			if err := rewriteFile(filepath.Join(root, hits[i].File), pattern); err != nil {
+				return err
+			}
+			done[hits[i].File] = true
+		}
+		hits[i].Rewritten = true
+	}
+	return nil
+}
+func rewriteFile(path string, pattern *regexp.Regexp) error {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return os.Symlink(string(relocate([]byte(target), pattern)), path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, relocate(content, pattern), stat.Mode().Perm())
+}
+
+// checkRelocatable looks for workspace and staging paths left in the package of t once it was installed locally
+// With rewrite text files are relocated to the install prefix, remaining hits are warnings, or an error when strict
+func checkRelocatable(t *buildTarget, rewrite bool, strict bool) error {
+	root := workspaceDir(t.Package)
+	pattern := buildPathPattern(t)
+	hits, err := scanBuildPaths(root, pattern)
+	if err != nil {
+		return err
+	}
+	if rewrite {
+		if err := rewriteBuildPaths(root, hits, pattern); err != nil {
+			return err
+		}
+	}
+	var unresolved []string
+	for _, hit := range hits {
+		if hit.Rewritten {
+			fmt.Printf("Relocated %s in %s\n", hit.Path, hit.File)
+			continue
+		}
+		unresolved = append(unresolved, hit.String())
+		if strict {
+			color.Red("ERROR - RELOCATABLE: %s", hit)
+		} else {
+			color.Yellow("WARNING - RELOCATABLE: %s", hit)
+		}
+	}
+	delete(t.State.Outputs, "buildPaths")
+	if len(unresolved) == 0 {
+		return nil
+	}
+	t.State.Outputs["buildPaths"] = strings.Join(unresolved, "\n")
+	if !strict {
+		return nil
+	}
+	if rewrite {
+		return fmt.Errorf("%d build paths left in binaries, the package will break once installed", len(unresolved))
+	}
+	return fmt.Errorf("%d build paths left in the package, use --rewrite-paths to relocate text files", len(unresolved))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildPathPattern(t *testing.T) {
+	workspaceRoot = "/tmp/fermenter"
+	target := &buildTarget{Root: "/tmp/fermenter"}
+	pattern := buildPathPattern(target)
+	installed := installedDir()
+	tests := []struct {
+		name  string
+		in    string
+		paths []string
+		out   string
+	}{
+		{"package directory", "prefix=/tmp/fermenter/zlib\n", []string{"/tmp/fermenter/zlib"}, "prefix=" + installed + "/zlib\n"},
+		{"file below package", "/tmp/fermenter/zlib/lib/libz.so", []string{"/tmp/fermenter/zlib"}, installed + "/zlib/lib/libz.so"},
+		{"dependency root", "-L/tmp/fermenter/deps/zlib/lib", []string{"/tmp/fermenter/deps/zlib"}, "-L" + installed + "/zlib/lib"},
+		{"root only", "cd /tmp/fermenter && make", []string{"/tmp/fermenter"}, "cd " + installed + " && make"},
+		{"root at end of text", "cd /tmp/fermenter", []string{"/tmp/fermenter"}, "cd " + installed},
+		{"root with slash", "\"/tmp/fermenter/\"", []string{"/tmp/fermenter"}, "\"" + installed + "/\""},
+		{"quoted list", "'/tmp/fermenter/a':'/tmp/fermenter/b'", []string{"/tmp/fermenter/a", "/tmp/fermenter/b"}, "'" + installed + "/a':'" + installed + "/b'"},
+		{"log file next to root", "see /tmp/fermenter.log", nil, "see /tmp/fermenter.log"},
+		{"cache next to root", "/tmp/fermenter-cache/ab", nil, "/tmp/fermenter-cache/ab"},
+		{"longer root name", "/tmp/fermenters/zlib", nil, "/tmp/fermenters/zlib"},
+		{"package named like deps", "/tmp/fermenter/depsfoo/bin", []string{"/tmp/fermenter/depsfoo"}, installed + "/depsfoo/bin"},
+		{"binary string", "\x00/tmp/fermenter/zlib\x00", []string{"/tmp/fermenter/zlib"}, "\x00" + installed + "/zlib\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			for _, span := range buildPathSpans(pattern, []byte(tt.in)) {
+				paths = append(paths, tt.in[span[0]:span[1]])
+			}
+			if len(paths) != len(tt.paths) {
+				t.Fatalf("found %q, want %q", paths, tt.paths)
+			}
+			for i := range paths {
+				if paths[i] != tt.paths[i] {
+					t.Fatalf("found %q, want %q", paths, tt.paths)
+				}
+			}
+			if got := string(relocate([]byte(tt.in), pattern)); got != tt.out {
+				t.Fatalf("relocate(%q) = %q, want %q", tt.in, got, tt.out)
+			}
+		})
+	}
+}
+
+func TestScanBuildPathsSkipsBuildSystem(t *testing.T) {
+	root := t.TempDir()
+	workspaceRoot = "/tmp/fermenter"
+	pattern := buildPathPattern(&buildTarget{Root: "/tmp/fermenter"})
+	files := map[string]bool{
+		"Makefile":                   false,
+		"config.status":              false,
+		"src/main.o":                 false,
+		"src/.deps/main.Po":          false,
+		"CMakeFiles/foo.dir/flags":   false,
+		"lib/libfoo.la":              false,
+		"lib/pkgconfig/foo.pc":       true,
+		"bin/foo-config":             true,
+		"share/doc/foo/Makefile.txt": true,
+	}
+	for name := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("prefix=/tmp/fermenter/foo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hits, err := scanBuildPaths(root, pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, hit := range hits {
+		found[filepath.ToSlash(hit.File)] = true
+	}
+	for name, want := range files {
+		if found[name] != want {
+			t.Errorf("%s reported = %v, want %v", name, found[name], want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processUsage is the exit code and resource usage of a process run during a phase
+type processUsage struct {
+	Arch             string  `json:"arch,omitempty"`
+	Log              string  `json:"log,omitempty"`
+	ExitCode         int     `json:"exitCode"`
+	PeakRSSBytes     int64   `json:"peakRssBytes"`
+	UserCPUSeconds   float64 `json:"userCpuSeconds"`
+	SystemCPUSeconds float64 `json:"systemCpuSeconds"`
+	// Limit is the resource limit that stopped the process, e.g. out of memory
+	Limit string `json:"limit,omitempty"`
+}
+
+// processUsageOf reads the exit code and rusage of a finished process
+func processUsageOf(state *os.ProcessState) processUsage {
+	var usage processUsage
+	if state == nil {
+		usage.ExitCode = -1
+		return usage
+	}
+	usage.ExitCode = state.ExitCode()
+	usage.UserCPUSeconds = state.UserTime().Seconds()
+	usage.SystemCPUSeconds = state.SystemTime().Seconds()
+	usage.PeakRSSBytes = maxRSSBytes(state)
+	return usage
+}
+
+// buildReport is the machine readable summary of a build target
+type buildReport struct {
+	Package       string         `json:"package"`
+	Version       string         `json:"version"`
+	Arch          string         `json:"arch"`
+	Status        string         `json:"status"`
+	BarrellSHA256 string         `json:"barrellSha256"`
+	Source        sourceReport   `json:"source"`
+	Phases        []phaseReport  `json:"phases"`
+	Archive       *archiveReport `json:"archive,omitempty"`
+	Upload        *uploadReport  `json:"upload,omitempty"`
+	Log           string         `json:"log"`
+	Network       string         `json:"network,omitempty"`
+	Suggestions   []string       `json:"suggestions,omitempty"`
+	CompilerCache *cacheReport   `json:"compilerCache,omitempty"`
+	Libraries     []string       `json:"libraryProblems,omitempty"`
+	BuildPaths    []string       `json:"buildPaths,omitempty"`
+}
+type sourceReport struct {
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Commit string `json:"commit,omitempty"`
+}
+type phaseReport struct {
+	Name            string         `json:"name"`
+	Status          string         `json:"status"`
+	Start           time.Time      `json:"start"`
+	End             time.Time      `json:"end"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Error           string         `json:"error,omitempty"`
+	Processes       []processUsage `json:"processes,omitempty"`
+}
+type archiveReport struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+	Parts int    `json:"parts,omitempty"`
+	// Signature is the detached signature written with --sign-key
+	Signature string `json:"signature,omitempty"`
+}
+type cacheReport struct {
+	Tool   string `json:"tool"`
+	Hits   int64  `json:"hits"`
+	Misses int64  `json:"misses"`
+}
+type uploadReport struct {
+	Status string `json:"status"`
+	File   string `json:"file,omitempty"`
+	Parts  int    `json:"parts,omitempty"`
+}
+
+// newBuildReport collects the report of t from its persisted state
+func newBuildReport(t *buildTarget) buildReport {
+	report := buildReport{
+		Package: t.Package,
+		Arch:    t.archLabel(),
+		Status:  "success",
+		Log:     t.State.Outputs["log"],
+		Network: t.State.Outputs["network"],
+		Source: sourceReport{
+			URL:    t.State.Outputs["sourceURL"],
+			SHA256: t.State.Outputs["sourceSHA256"],
+			Commit: t.State.Outputs["sourceCommit"],
+		},
+	}
+	report.Version, _ = getBarrellAttribute(t.Package, "version", t.Options.Barrells)
+	if content, err := os.ReadFile(t.Path); err == nil {
+		sum := sha256.Sum256(content)
+		report.BarrellSHA256 = hex.EncodeToString(sum[:])
+	}
+	for _, p := range t.phases {
+		record, ok := t.State.Phases[p.Name]
+		if !ok {
+			continue
+		}
+		if record.Status == phaseFailed || record.Status == phaseRunning {
+			report.Status = "failed"
+		}
+		report.Phases = append(report.Phases, phaseReport{
+			Name:            p.Name,
+			Status:          record.Status,
+			Start:           record.Start,
+			End:             record.End,
+			DurationSeconds: record.End.Sub(record.Start).Seconds(),
+			Error:           record.Error,
+			Processes:       record.Processes,
+		})
+	}
+	if suggestions := t.State.Outputs["suggestions"]; suggestions != "" {
+		report.Suggestions = strings.Split(suggestions, "\n")
+	}
+	if problems := t.State.Outputs["libraryProblems"]; problems != "" {
+		report.Libraries = strings.Split(problems, "\n")
+	}
+	if paths := t.State.Outputs["buildPaths"]; paths != "" {
+		report.BuildPaths = strings.Split(paths, "\n")
+	}
+	if tool := t.State.Outputs["compilerCache"]; tool != "" {
+		report.CompilerCache = &cacheReport{Tool: tool}
+		report.CompilerCache.Hits, _ = strconv.ParseInt(t.State.Outputs["compilerCacheHits"], 10, 64)
+		report.CompilerCache.Misses, _ = strconv.ParseInt(t.State.Outputs["compilerCacheMisses"], 10, 64)
+	}
+	parts, _ := strconv.Atoi(t.State.Outputs["parts"])
+	if t.hasOutput("archive") {
+		archive := t.State.Outputs["archive"]
+		report.Archive = &archiveReport{Path: archive, Parts: parts, Signature: t.State.Outputs["signature"]}
+		if stat, err := os.Stat(archive); err == nil {
+			report.Archive.Size = stat.Size()
+		}
+		report.Archive.Files, _ = countArchiveFiles(archive)
+	}
+	if record, ok := t.State.Phases["upload"]; ok {
+		report.Upload = &uploadReport{Status: record.Status, File: t.State.Outputs["upload"], Parts: parts}
+	}
+	return report
+}
+
+// countArchiveFiles returns the number of regular files in a prebuild archive
+func countArchiveFiles(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			count++
+		}
+	}
+}
+
+// writeReports saves the report of t in its workspace and every report so far to reportFile if set
+func writeReports(t *buildTarget, reports []buildReport, reportFile string) error {
+	content, err := json.MarshalIndent(reports[len(reports)-1], "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(t.Root, fmt.Sprintf(".%s-report.json", t.Package)), content, 0644); err != nil {
+		return err
+	}
+	if reportFile == "" {
+		return nil
+	}
+	content, err = json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportFile, content, 0644)
+}
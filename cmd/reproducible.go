@@ -0,0 +1,421 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// maxDiffSize is the largest text file shown as a unified diff
+const maxDiffSize = 1 << 20
+
+// verifyReproducibleCmd represents the verify-reproducible command
+var verifyReproducibleCmd = &cobra.Command{
+	Use:   "verify-reproducible <package>",
+	Short: "Build a package twice and compare the archives",
+	Long: `Builds a package twice in separate workspaces with a different working directory, timezone and clock
+and compares the resulting archives file by file. Exits with a non zero status when they differ`,
+	Run: func(cmd *cobra.Command, args []string) {
+		barrellsLoc, err := cmd.Flags().GetString("barrells")
+		barrellsloc = barrellsLoc
+		if err != nil {
+			panic(err)
+		}
+		arch, err := cmd.Flags().GetString("arch")
+		if err != nil {
+			panic(err)
+		}
+		keep, err := cmd.Flags().GetBool("keep")
+		if err != nil {
+			panic(err)
+		}
+		if dir, err := isDir(barrellsLoc); err != nil || !dir {
+			color.Red("ERROR: Barrells location is not a directory or does not exist")
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			color.Red("ERROR: Please specify a package to build")
+			os.Exit(1)
+		}
+		args[0] = convertToReadableString(args[0])
+		pkg := fmt.Sprintf("%s/%s.py", barrellsLoc, args[0])
+		if !doesExist(pkg) {
+			color.Red("ERROR: Package not found in %s\n", barrellsLoc)
+			os.Exit(1)
+		}
+		if err := installDependencyClosure(args[0], barrellsLoc, dependencySource{}, buildSets...); err != nil {
+			color.Red("ERROR - DEPS: %s", err)
+			os.Exit(1)
+		}
+		//vary the workspace path, timezone and clock between both builds so embedded paths and dates show up
+		timezones := []string{"UTC", "Etc/GMT-14"}
+		clockShifts := []time.Duration{0, reproClockShift}
+		if fakeTimeLibrary() == "" {
+			color.Yellow("WARNING - REPRODUCIBLE: libfaketime not found, both builds see the same clock")
+		}
+		//both builds get the same SOURCE_DATE_EPOCH, a barrell honouring it must not change with the clock
+		epoch := time.Now().Unix()
+		var roots []string
+		var archives []string
+		cleanup := func() {
+			if keep {
+				return
+			}
+			for _, root := range roots {
+				os.RemoveAll(root)
+				os.Remove(root + ".tar.gz")
+			}
+		}
+		for i, tz := range timezones {
+			root, err := os.MkdirTemp("", "fermenter-repro-")
+			if err != nil {
+				cleanup()
+				color.Red("ERROR - REPRODUCIBLE: %s", err)
+				os.Exit(1)
+			}
+			roots = append(roots, root)
+			workspaceRoot = root
+			os.Setenv("TZ", tz)
+			color.Yellow("Build %d of %d in %s (TZ=%s, clock +%s)", i+1, len(timezones), root, tz, clockShifts[i])
+			if !downloadsource(args[0], barrellsLoc) {
+				color.Red("ERROR - DOWNLOAD: unable to download source")
+				os.Exit(1)
+			}
+			//the clock is only moved for the build itself, the archives are written with the same epoch
+			restore := setEnv(clockEnv(clockShifts[i], epoch))
+			_, err = runBuildCommand(pkg, args[0], arch)
+			restore()
+			if err != nil {
+				color.Red("ERROR - BUILD: %s", err)
+				os.Exit(1)
+			}
+			//the compress phase writes the metadata and the files manifest into the archive as well
+			t := newBuildTarget(pkg, args[0], arch, false, root, buildOptions{Barrells: barrellsLoc, NoUpload: true})
+			if err := phaseCompress(t); err != nil {
+				color.Red("ERROR - COMPRESS: %s", err)
+				os.Exit(1)
+			}
+			archive := root + ".tar.gz"
+			if err := os.Rename(t.archive(), archive); err != nil {
+				color.Red("ERROR - COMPRESS: %s", err)
+				os.Exit(1)
+			}
+			archives = append(archives, archive)
+		}
+		diffs, err := diffArchives(archives[0], archives[1])
+		cleanup()
+		if err != nil {
+			color.Red("ERROR - REPRODUCIBLE: %s", err)
+			os.Exit(1)
+		}
+		if len(diffs) == 0 {
+			color.Green("PASS: %s is reproducible", args[0])
+			return
+		}
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		color.Red("FAIL: %s is not reproducible, %d files differ", args[0], len(diffs))
+		if keep {
+			fmt.Printf("Workspaces kept at %s and %s\n", roots[0], roots[1])
+		}
+		os.Exit(1)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyReproducibleCmd)
+	location, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	location = location[:len(location)-len("/fermenter")]
+	verifyReproducibleCmd.Flags().StringP("barrells", "b", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
+	verifyReproducibleCmd.Flags().String("arch", "", "Arch passed to the barrell, defaults to universal")
+	verifyReproducibleCmd.Flags().Bool("keep", false, "Keep both workspaces and archives for inspection")
+}
+
+// reproClockShift is how far ahead the clock of the second build runs, more than a year so the date changes in every field
+const reproClockShift = 397 * 24 * time.Hour
+
+// fakeTimeLibraries are the usual install locations of libfaketime
+var fakeTimeLibraries = []string{
+	"/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1", "/usr/lib/aarch64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib64/faketime/libfaketime.so.1", "/usr/lib/faketime/libfaketime.so.1", "/usr/local/lib/faketime/libfaketime.so.1",
+	"/opt/homebrew/lib/faketime/libfaketime.1.dylib", "/usr/local/lib/faketime/libfaketime.1.dylib",
+}
+
+// fakeTimeLibrary returns the path of libfaketime, or "" when it is not installed
+func fakeTimeLibrary() string {
+	for _, lib := range fakeTimeLibraries {
+		if doesExist(lib) {
+			return lib
+		}
+	}
+	return ""
+}
+
+// clockEnv returns the environment that makes a build see a clock shift ahead
+// SOURCE_DATE_EPOCH is set to epoch unless the user set it, it stays the same whatever the shift
+func clockEnv(shift time.Duration, epoch int64) map[string]string {
+	env := make(map[string]string)
+	if os.Getenv("SOURCE_DATE_EPOCH") == "" {
+		env["SOURCE_DATE_EPOCH"] = strconv.FormatInt(epoch, 10)
+	}
+	lib := fakeTimeLibrary()
+	if shift == 0 || lib == "" {
+		return env
+	}
+	env["FAKETIME"] = fmt.Sprintf("+%ds", int64(shift.Seconds()))
+	if strings.HasSuffix(lib, ".dylib") {
+		env["DYLD_INSERT_LIBRARIES"] = lib
+		env["DYLD_FORCE_FLAT_NAMESPACE"] = "1"
+	} else {
+		env["LD_PRELOAD"] = lib
+	}
+	return env
+}
+
+// setEnv sets env in the environment of fermenter and returns a func restoring the previous values
+func setEnv(env map[string]string) func() {
+	previous := make(map[string]*string)
+	for key, value := range env {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, old := range previous {
+			if old == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *old)
+			}
+		}
+	}
+}
+
+// archiveEntry is a single file read from a prebuild archive
+type archiveEntry struct {
+	Mode     int64
+	Size     int64
+	Linkname string
+	Sum      [sha256.Size]byte
+	// Content is only kept for files small enough to diff
+	Content []byte
+}
+
+func readArchiveEntries(path string) (map[string]archiveEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	entries := make(map[string]archiveEntry)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := archiveEntry{Mode: hdr.Mode, Size: hdr.Size, Linkname: hdr.Linkname}
+		h := sha256.New()
+		var content bytes.Buffer
+		w := io.Writer(h)
+		if hdr.Size <= maxDiffSize {
+			w = io.MultiWriter(h, &content)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return nil, err
+		}
+		copy(entry.Sum[:], h.Sum(nil))
+		if hdr.Size <= maxDiffSize {
+			entry.Content = content.Bytes()
+		}
+		entries[hdr.Name] = entry
+	}
+	return entries, nil
+}
+
+// diffArchives compares two archives and returns a description of every file that differs
+func diffArchives(a string, b string) ([]string, error) {
+	first, err := readArchiveEntries(a)
+	if err != nil {
+		return nil, err
+	}
+	second, err := readArchiveEntries(b)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range first {
+		names = append(names, name)
+	}
+	for name := range second {
+		if _, ok := first[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var diffs []string
+	for _, name := range names {
+		x, inFirst := first[name]
+		y, inSecond := second[name]
+		switch {
+		case !inSecond:
+			diffs = append(diffs, color.YellowString("%s: only in first build", name))
+		case !inFirst:
+			diffs = append(diffs, color.YellowString("%s: only in second build", name))
+		case x.Linkname != y.Linkname:
+			diffs = append(diffs, color.YellowString("%s: symlink %s != %s", name, x.Linkname, y.Linkname))
+		case x.Mode != y.Mode:
+			diffs = append(diffs, color.YellowString("%s: mode %o != %o", name, x.Mode, y.Mode))
+		case x.Sum != y.Sum:
+			msg := color.YellowString("%s: content differs (%d bytes vs %d bytes)", name, x.Size, y.Size)
+			if isText(x.Content) && isText(y.Content) {
+				msg += "\n" + unifiedDiff(name, string(x.Content), string(y.Content))
+			}
+			diffs = append(diffs, msg)
+		}
+	}
+	return diffs, nil
+}
+
+// isText reports whether content was kept and looks like text
+func isText(content []byte) bool {
+	return content != nil && utf8.Valid(content) && !bytes.ContainsRune(content, 0)
+}
+
+// diffOp is a single line of a diff, kind is one of ' ', '-' or '+'
+type diffOp struct {
+	kind byte
+	line string
+	a, b int
+}
+
+// unifiedDiff returns a unified diff of a and b with three lines of context
+func unifiedDiff(name string, a string, b string) string {
+	x := splitLines(a)
+	y := splitLines(b)
+	if len(x)*len(y) > 1e7 {
+		return "  (too large to diff)\n"
+	}
+	//lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, diffOp{' ', x[i], i, j})
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', x[i], i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', y[j], i, j})
+			j++
+		}
+	}
+	const context = 3
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		//extend the hunk until there are more than 2*context unchanged lines in a row
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*context {
+				break
+			}
+		}
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(ops) {
+			to = len(ops)
+		}
+		var aLen, bLen int
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[from].a+1, aLen, ops[from].b+1, bLen)
+		for _, op := range ops[from:to] {
+			line := string(op.kind) + op.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			switch op.kind {
+			case '-':
+				out.WriteString(color.RedString("%s", line))
+			case '+':
+				out.WriteString(color.GreenString("%s", line))
+			default:
+				out.WriteString(line)
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// splitLines splits s after every newline without a trailing empty line
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
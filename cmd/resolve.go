@@ -0,0 +1,163 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Dependency sets a barrell can declare, runtime dependencies are also needed to build and test
+const (
+	buildDependencies   = "build_dependencies"
+	runtimeDependencies = "dependencies"
+	testDependencies    = "test_dependencies"
+)
+
+// Dependency sets installed for each phase
+var (
+	buildSets = []string{buildDependencies, runtimeDependencies}
+	testSets  = []string{buildDependencies, runtimeDependencies, testDependencies}
+)
+
+// dependenciesFor returns the dependency specs of the barrell at path in every one of sets
+func dependenciesFor(path string, pkg string, sets ...string) ([]string, error) {
+	var specs []string
+	for _, set := range sets {
+		set, err := getDependencySet(path, pkg, set)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range set {
+			if !containsString(specs, spec) {
+				specs = append(specs, spec)
+			}
+		}
+	}
+	return specs, nil
+}
+
+// resolution is the transitive dependency closure of a package
+type resolution struct {
+	Root  string
+	graph *depGraph
+	// specs are the dependency specs as written in the barrells, by package
+	specs map[string][]string
+	// Missing are dependencies without a barrell, with the packages needing them
+	Missing map[string][]string
+	// Order installs every dependency after its own dependencies and ends with Root
+	Order []string
+}
+
+// resolveDependencies reads the dependencies in sets of pkg and the runtime dependencies of every barrell it depends on
+// Dependencies are installed from prebuilds, so their own build dependencies are not needed
+// Fails on dependency cycles, dependencies without a barrell are reported in Missing
+func resolveDependencies(pkg string, barrellsLoc string, sets ...string) (*resolution, error) {
+	r := &resolution{
+		Root:    pkg,
+		graph:   newDepGraph(),
+		specs:   make(map[string][]string),
+		Missing: make(map[string][]string),
+	}
+	queue := []string{pkg}
+	seen := map[string]bool{pkg: true}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		var deps []string
+		currentSets := []string{runtimeDependencies}
+		if current == pkg {
+			currentSets = sets
+		}
+		specs, err := dependenciesFor(barrellPath(current, barrellsLoc), current, currentSets...)
+		if err != nil {
+			return r, err
+		}
+		for _, spec := range specs {
+			name := dependencyPackage(spec)
+			if name == "" || name == current {
+				continue
+			}
+			if !containsString(r.specs[name], spec) {
+				r.specs[name] = append(r.specs[name], spec)
+			}
+			if !doesExist(barrellPath(name, barrellsLoc)) {
+				r.Missing[name] = append(r.Missing[name], current)
+				continue
+			}
+			deps = append(deps, name)
+			if !seen[name] {
+				seen[name] = true
+				queue = append(queue, name)
+			}
+		}
+		r.graph.add(current, deps)
+	}
+	order, err := r.graph.topoOrder()
+	if err != nil {
+		return r, err
+	}
+	r.Order = order
+	return r, nil
+}
+
+// barrellPath returns the barrell file of pkg
+func barrellPath(pkg string, barrellsLoc string) string {
+	return filepath.Join(barrellsLoc, pkg+".py")
+}
+
+// dependencies returns the direct dependencies of pkg that have a barrell
+func (r *resolution) dependencies(pkg string) []string {
+	return r.graph.deps[pkg]
+}
+
+// missing returns the dependencies without a barrell in sorted order
+func (r *resolution) missing() []string {
+	var names []string
+	for name := range r.Missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// installSpecs returns the dependency specs of the closure in install order, without the root
+// Dependencies without a barrell come first since nothing in the closure can provide them
+func (r *resolution) installSpecs() []string {
+	var specs []string
+	for _, name := range r.missing() {
+		specs = append(specs, r.specs[name]...)
+	}
+	for _, pkg := range r.Order {
+		if pkg != r.Root {
+			specs = append(specs, r.specs[pkg]...)
+		}
+	}
+	return specs
+}
+
+// installDependencyClosure installs every dependency in sets of pkg in dependency order from source
+func installDependencyClosure(pkg string, barrellsLoc string, source dependencySource, sets ...string) error {
+	r, err := resolveDependencies(pkg, barrellsLoc, sets...)
+	if err != nil {
+		return err
+	}
+	for _, name := range r.missing() {
+		color.Yellow("No barrell for %s, needed by %s", name, strings.Join(r.Missing[name], ", "))
+	}
+	probes := make(map[string][]string)
+	for _, p := range r.Order {
+		declared, err := getBarrellProbes(p, barrellsLoc)
+		if err != nil {
+			return err
+		}
+		for dep, list := range declared {
+			probes[dep] = append(probes[dep], list...)
+		}
+	}
+	return installDependencies(r.installSpecs(), probes, barrellsLoc, source)
+}
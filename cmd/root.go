@@ -64,6 +64,7 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.fermenter.yaml)")
+	rootCmd.PersistentFlags().StringVar(&prefixFlag, "prefix", defaultPrefix, "Install prefix packages are built, linked and recorded in, e.g. /opt/ferment or $HOME/.ferment")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,17 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSSBytes converts ru_maxrss, which linux reports in kilobytes
+func maxRSSBytes(state *os.ProcessState) int64 {
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return ru.Maxrss * 1024
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import "os"
+
+// maxRSSBytes is not reported on this platform
+func maxRSSBytes(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// shellCmd represents the shell command
+var shellCmd = &cobra.Command{
+	Use:   "shell <package>",
+	Short: "Open a shell in the downloaded workspace of a package",
+	Long: `Installs the dependencies of a package and downloads its source without building it, then opens
+an interactive shell in the workspace with the environment the barrell is built with.
+Run rebuild inside the shell to run pkg.build()`,
+	Run: func(cmd *cobra.Command, args []string) {
+		barrellsLoc, err := cmd.Flags().GetString("barrells")
+		barrellsloc = barrellsLoc
+		if err != nil {
+			panic(err)
+		}
+		arch, err := cmd.Flags().GetString("arch")
+		if err != nil {
+			panic(err)
+		}
+		if dir, err := isDir(barrellsLoc); err != nil || !dir {
+			color.Red("ERROR: Barrells location is not a directory or does not exist")
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			color.Red("ERROR: Please specify a package")
+			os.Exit(1)
+		}
+		args[0] = convertToReadableString(args[0])
+		pkg := fmt.Sprintf("%s/%s.py", barrellsLoc, args[0])
+		if !doesExist(pkg) {
+			color.Red("ERROR: Package not found in %s\n", barrellsLoc)
+			os.Exit(1)
+		}
+		t := newBuildTarget(pkg, args[0], arch, false, workspaceRoot, buildOptions{Barrells: barrellsLoc})
+		if _, err := runPipeline(t, phaseSelection{To: "download"}, nil); err != nil {
+			color.Red("ERROR - %s", err)
+			os.Exit(1)
+		}
+		if err := debugShell(pkg, args[0], arch); err != nil {
+			color.Red("ERROR - SHELL: %s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+	location, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	location = location[:len(location)-len("/fermenter")]
+	shellCmd.Flags().String("barrells", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
+	shellCmd.Flags().String("arch", "", "Arch passed to the barrell as pkg.arch")
+}
+
+// debugShell opens an interactive shell in the workspace of pkg with the build environment
+// A rebuild helper on PATH runs pkg.build() from the barrell at path again
+func debugShell(path string, pkg string, arch string) error {
+	helpers, err := os.MkdirTemp("", "fermenter-shell-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(helpers)
+	err = os.WriteFile(filepath.Join(helpers, "rebuild"), []byte(rebuildScript(path, pkg, arch)), 0755)
+	if err != nil {
+		return err
+	}
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell)
+	cmd.Dir = workspaceDir(pkg)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(withPath(buildEnvironment(), helpers), "FERMENTER_SHELL="+pkg)
+	color.Yellow("Opening a shell in %s, run rebuild to run pkg.build() again and exit to leave", cmd.Dir)
+	// the shell exits with the status of the last command run in it, only failing to start it is an error
+	if err := cmd.Run(); err != nil {
+		if _, exited := err.(*exec.ExitError); exited {
+			return nil
+		}
+		return fmt.Errorf("%s: %s", shell, err)
+	}
+	return nil
+}
+
+// rebuildScript is a shell script running pkg.build() the way build does, the barrell is read again on every run
+func rebuildScript(path string, pkg string, arch string) string {
+	return fmt.Sprintf("#!/bin/sh\ncd %s || exit 1\n{ cat %s; cat <<'FERMENTER_EOF'\n%sFERMENTER_EOF\n} | python3\n",
+		shellQuote(filepath.Dir(path)), shellQuote(path), buildInvocation(pkg, arch))
+}
+
+// buildInvocation is the python appended to a barrell to run its build
+func buildInvocation(pkg string, arch string) string {
+	if arch == "" {
+		arch = "universal"
+	}
+	var b strings.Builder
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "pkg=%s()\n", convertToReadableString(strings.ToLower(pkg)))
+	fmt.Fprintf(&b, `pkg.cwd="%s"`+"\n", workspaceDir(pkg))
+	fmt.Fprintf(&b, `pkg.arch="%s"`+"\n", arch)
+	fmt.Fprintf(&b, `pkg.prefix="%s"`+"\n", fermentPrefix())
+	b.WriteString("pkg.build()\n")
+	return b.String()
+}
+
+// withPath returns env with dir put in front of PATH
+func withPath(env []string, dir string) []string {
+	result := make([]string, 0, len(env)+1)
+	path := dir
+	for _, v := range env {
+		if strings.HasPrefix(v, "PATH=") {
+			path = dir + string(os.PathListSeparator) + strings.TrimPrefix(v, "PATH=")
+			continue
+		}
+		result = append(result, v)
+	}
+	return append(result, "PATH="+path)
+}
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
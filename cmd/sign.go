@@ -0,0 +1,427 @@
+/*
+Copyright © 2022 NotTimIsReal
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// signatureSuffix is appended to the archive path for its detached signature
+const signatureSuffix = ".sig"
+
+// artifactSignature is the detached signature written next to a prebuild archive
+// The ed25519 signature covers signedMessage of the archive and metadata hashes
+type artifactSignature struct {
+	Algorithm      string `json:"algorithm"`
+	KeyID          string `json:"keyId"`
+	ArchiveSHA256  string `json:"archiveSha256"`
+	MetadataSHA256 string `json:"metadataSha256"`
+	Signature      []byte `json:"signature"`
+}
+
+// signedMessage is the byte string the signature is made over, versioned so the format can change later
+func (s artifactSignature) signedMessage() []byte {
+	return []byte(fmt.Sprintf("fermenter-signature-v1\n%s\n%s\n", s.ArchiveSHA256, s.MetadataSHA256))
+}
+
+// keyID identifies a public key by the start of its sha256
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// readPrivateKey reads a PKCS #8 PEM ed25519 private key as written by keygen
+func readPrivateKey(file string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not a PEM private key", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", file)
+	}
+	return private, nil
+}
+
+// readPublicKey reads a PKIX PEM ed25519 public key as written by keygen
+func readPublicKey(file string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s is not a PEM public key", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", file)
+	}
+	return public, nil
+}
+
+// archiveEntryContent returns the content of the regular file at name in a gzipped tarball
+func archiveEntryContent(archive string, name string) ([]byte, error) {
+	var content []byte
+	err := walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name != name {
+			return nil
+		}
+		var err error
+		content, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, fmt.Errorf("%s has no %s", archive, name)
+	}
+	return content, nil
+}
+
+// walkArchive calls fn for every entry of a gzipped tarball
+func walkArchive(archive string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveRoot returns the package directory every entry of a prebuild archive lives in
+func archiveRoot(archive string) (string, error) {
+	var root string
+	err := walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		if root == "" {
+			root = strings.SplitN(strings.TrimPrefix(hdr.Name, "./"), "/", 2)[0]
+		}
+		return nil
+	})
+	if err == nil && root == "" {
+		err = fmt.Errorf("%s is empty", archive)
+	}
+	return root, err
+}
+
+// signArchive writes the detached signature of archive made with the private key at keyFile
+func signArchive(archive string, keyFile string) (string, error) {
+	key, err := readPrivateKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+	sig := artifactSignature{Algorithm: "ed25519", KeyID: keyID(key.Public().(ed25519.PublicKey))}
+	sig.ArchiveSHA256, err = fileSHA256(archive)
+	if err != nil {
+		return "", err
+	}
+	root, err := archiveRoot(archive)
+	if err != nil {
+		return "", err
+	}
+	metadata, err := archiveEntryContent(archive, path.Join(root, metadataDir, "metadata.json"))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(metadata)
+	sig.MetadataSHA256 = hex.EncodeToString(sum[:])
+	sig.Signature = ed25519.Sign(key, sig.signedMessage())
+	content, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	output := archive + signatureSuffix
+	return output, os.WriteFile(output, content, 0644)
+}
+
+// signIfRequested signs the archive of t when --sign-key was given
+// Otherwise a signature left by an earlier build is removed so it is not uploaded with the new archive
+func signIfRequested(t *buildTarget) error {
+	if t.Options.SignKey == "" {
+		os.Remove(t.archive() + signatureSuffix)
+		return nil
+	}
+	sig, err := signArchive(t.archive(), t.Options.SignKey)
+	if err != nil {
+		return fmt.Errorf("signing %s: %s", t.archive(), err)
+	}
+	t.State.Outputs["signature"] = sig
+	return nil
+}
+
+// verifyArchive checks the signature of archive against pub, then the metadata and the files manifest it contains
+// Every problem found is returned, the error is only set when the archive can not be read
+func verifyArchive(archive string, sigFile string, pub ed25519.PublicKey) ([]string, error) {
+	var problems []string
+	content, err := os.ReadFile(sigFile)
+	if err != nil {
+		return nil, err
+	}
+	var sig artifactSignature
+	if err := json.Unmarshal(content, &sig); err != nil {
+		return nil, fmt.Errorf("%s: %s", sigFile, err)
+	}
+	if sig.Algorithm != "ed25519" {
+		problems = append(problems, fmt.Sprintf("unsupported signature algorithm %q", sig.Algorithm))
+	} else if sig.KeyID != keyID(pub) {
+		problems = append(problems, fmt.Sprintf("signed with key %s, not with the given key %s", sig.KeyID, keyID(pub)))
+	} else if !ed25519.Verify(pub, sig.signedMessage(), sig.Signature) {
+		problems = append(problems, "signature does not match")
+	}
+	sum, err := fileSHA256(archive)
+	if err != nil {
+		return nil, err
+	}
+	if sum != sig.ArchiveSHA256 {
+		problems = append(problems, fmt.Sprintf("archive sha256 is %s, the signature is for %s", sum, sig.ArchiveSHA256))
+	}
+
+	root, err := archiveRoot(archive)
+	if err != nil {
+		return nil, err
+	}
+	metadataName := path.Join(root, metadataDir, "metadata.json")
+	manifestName := path.Join(root, metadataDir, filesManifest)
+	type entry struct {
+		sum  string
+		mode string
+		size int64
+	}
+	entries := make(map[string]entry)
+	var metadataContent, manifestContent []byte
+	err = walkArchive(archive, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), root+"/")
+		var err error
+		switch {
+		case hdr.Name == metadataName:
+			metadataContent, err = io.ReadAll(r)
+			return err
+		case hdr.Name == manifestName:
+			manifestContent, err = io.ReadAll(r)
+			return err
+		case strings.HasPrefix(name, metadataDir+"/"):
+			return nil
+		case hdr.Typeflag == tar.TypeSymlink:
+			hash := sha256.Sum256([]byte(hdr.Linkname))
+			entries[name] = entry{hex.EncodeToString(hash[:]), manifestMode(hdr.FileInfo().Mode()), int64(len(hdr.Linkname))}
+		case hdr.Typeflag == tar.TypeReg:
+			h := sha256.New()
+			size, err := io.Copy(h, r)
+			if err != nil {
+				return err
+			}
+			entries[name] = entry{hex.EncodeToString(h.Sum(nil)), manifestMode(hdr.FileInfo().Mode()), size}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if metadataContent == nil {
+		problems = append(problems, "archive has no "+metadataName)
+	} else {
+		metadataSum := sha256.Sum256(metadataContent)
+		if hex.EncodeToString(metadataSum[:]) != sig.MetadataSHA256 {
+			problems = append(problems, "metadata.json does not match the signed metadata")
+		}
+		var metadata packageMetadata
+		if err := json.Unmarshal(metadataContent, &metadata); err != nil {
+			problems = append(problems, fmt.Sprintf("metadata.json: %s", err))
+		} else if metadata.Name != root {
+			problems = append(problems, fmt.Sprintf("metadata is for %s but the archive holds %s", metadata.Name, root))
+		} else if metadata.Version == "" || metadata.Arch == "" {
+			problems = append(problems, "metadata has no version or arch")
+		}
+	}
+
+	if manifestContent == nil {
+		problems = append(problems, "archive has no "+manifestName)
+		return problems, nil
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(manifestContent)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			problems = append(problems, fmt.Sprintf("invalid manifest line %q", line))
+			continue
+		}
+		name := fields[3]
+		listed[name] = true
+		got, ok := entries[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is in the manifest but not in the archive", name))
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		if got.sum != fields[0] || got.size != size {
+			problems = append(problems, fmt.Sprintf("%s does not match its manifest hash", name))
+		}
+		if got.mode != fields[1] {
+			problems = append(problems, fmt.Sprintf("%s has mode %s, the manifest says %s", name, got.mode, fields[1]))
+		}
+	}
+	for name := range entries {
+		if !listed[name] {
+			problems = append(problems, fmt.Sprintf("%s is in the archive but not in the manifest", name))
+		}
+	}
+	return problems, nil
+}
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Create an ed25519 keypair for signing prebuilds",
+	Long: `Writes a private key to <out>.key and its public key to <out>.pub. Builds signed with
+--sign-key <out>.key can be checked by anyone holding <out>.pub with fermenter verify`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, err := cmd.Flags().GetString("out")
+		if err != nil {
+			panic(err)
+		}
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			panic(err)
+		}
+		if !force && (doesExist(out+".key") || doesExist(out+".pub")) {
+			color.Red("ERROR: %s.key or %s.pub already exists, use --force to replace them", out, out)
+			os.Exit(1)
+		}
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			color.Red("ERROR - KEYGEN: %s", err)
+			os.Exit(1)
+		}
+		privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			panic(err)
+		}
+		publicDER, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(out+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+			color.Red("ERROR - KEYGEN: %s", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(out+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+			color.Red("ERROR - KEYGEN: %s", err)
+			os.Exit(1)
+		}
+		color.Green("Wrote %s.key and %s.pub (key id %s)", out, out, keyID(public))
+	},
+}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <archive>",
+	Short: "Check the signature, metadata and files manifest of a prebuild archive",
+	Long: `Checks the detached signature of a prebuild archive against a public key, then checks that the
+embedded metadata is the signed one and that every file matches the hash, mode and size in the
+files manifest. Exits with a non zero status when anything does not match`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pubFile, err := cmd.Flags().GetString("pubkey")
+		if err != nil {
+			panic(err)
+		}
+		sigFile, err := cmd.Flags().GetString("signature")
+		if err != nil {
+			panic(err)
+		}
+		if len(args) < 1 {
+			color.Red("ERROR: Please specify an archive")
+			os.Exit(1)
+		}
+		if pubFile == "" {
+			color.Red("ERROR: Please specify a public key with --pubkey")
+			os.Exit(1)
+		}
+		if sigFile == "" {
+			sigFile = args[0] + signatureSuffix
+		}
+		pub, err := readPublicKey(pubFile)
+		if err != nil {
+			color.Red("ERROR - VERIFY: %s", err)
+			os.Exit(1)
+		}
+		problems, err := verifyArchive(args[0], sigFile, pub)
+		if errors.Is(err, os.ErrNotExist) {
+			color.Red("ERROR - VERIFY: %s, is the archive signed?", err)
+			os.Exit(1)
+		}
+		if err != nil {
+			color.Red("ERROR - VERIFY: %s", err)
+			os.Exit(1)
+		}
+		if len(problems) == 0 {
+			color.Green("PASS: %s is signed by %s and matches its manifest", args[0], keyID(pub))
+			return
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		color.Red("FAIL: %s did not verify, %d problems", args[0], len(problems))
+		os.Exit(1)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	rootCmd.AddCommand(verifyCmd)
+	keygenCmd.Flags().StringP("out", "o", "fermenter-signing", "Path the .key and .pub files are written to, without extension")
+	keygenCmd.Flags().Bool("force", false, "Replace an existing keypair")
+	verifyCmd.Flags().String("pubkey", "", "Public key written by fermenter keygen")
+	verifyCmd.Flags().String("signature", "", "Detached signature, defaults to the archive path with .sig appended")
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"os"
+	"path/filepath"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
@@ -45,21 +46,40 @@ var testCmd = &cobra.Command{
 		color.Green("Found package %s\n", pkg)
 		validatePyFile(args[0], barrellsLoc)
 		downloadsource(args[0], barrellsLoc)
-		dep := getDependencies(pkg, args[0])
-		installDependencies(dep, pkg, barrellsLoc)
+		deps, err := readDependencySource(cmd)
+		if err != nil {
+			color.Red("ERROR: %s", err)
+			os.Exit(1)
+		}
+		if err := installDependencyClosure(args[0], barrellsLoc, deps, buildSets...); err != nil {
+			color.Red("ERROR - DEPS: %s", err)
+			os.Exit(1)
+		}
 		//get arch from go sys
 
-		runBuildCommand(pkg, args[0], runtime.GOARCH)
+		if _, err := runBuildCommand(pkg, args[0], runtime.GOARCH); err != nil {
+			color.Red("ERROR - BUILD: %s", err)
+			os.Exit(1)
+		}
 		fmt.Println("Printing Logs From Build If Exists")
 		fmt.Println(showLogs(args[0]))
-		compress(fmt.Sprintf("%s.tar.gz", args[0]), args[0])
-		fmt.Printf("Compress Path: /tmp/%s.tar.gz\n", args[0])
-		installPKG(args[0], barrellsLoc)
+		compress(archivePath(args[0], ""), args[0])
+		fmt.Printf("Compress Path: %s\n", archivePath(args[0], ""))
+		if err := installPKG(args[0], barrellsLoc); err != nil {
+			color.Red("ERROR - INSTALL: %s", err)
+			os.Exit(1)
+		}
+		//test dependencies are only needed by the tests, the build must not pick them up
+		if err := installDependencyClosure(args[0], barrellsLoc, deps, testSets...); err != nil {
+			color.Red("ERROR - DEPS: %s", err)
+			uninstallPKG(args[0], barrellsLoc)
+			os.Exit(1)
+		}
 		if !test(args[0], barrellsLoc) {
-			executeQuickPython(fmt.Sprintf("import os;from %s import %s;pkg=%s();pkg.cwd='/tmp/fermenter/%s/';pkg.uninstall()", args[0], args[0], args[0], args[0]), barrellsLoc)
+			uninstallPKG(args[0], barrellsLoc)
 			os.Exit(1)
 		}
-		executeQuickPython(fmt.Sprintf("import os;from %s import %s;pkg=%s();pkg.cwd='/tmp/fermenter/%s/';pkg.uninstall()", args[0], args[0], args[0], args[0]), barrellsLoc)
+		uninstallPKG(args[0], barrellsLoc)
 
 	},
 }
@@ -80,6 +100,7 @@ func init() {
 	}
 	location = location[:len(location)-len("/fermenter")]
 	testCmd.Flags().StringP("barrells", "b", fmt.Sprintf("%s/Barrells", location), "Path for the barrells")
+	addDependencySourceFlags(testCmd)
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -127,7 +148,7 @@ func test(pkg string, barrells string) bool {
 
 	}
 	spinner.Message("Found test")
-	out, err := executeQuickPython(fmt.Sprintf("from %s import %s;pkg=%s();pkg.cwd='/tmp/fermenter/%s';pkg.test()", pkg, pkg, pkg, pkg), barrells)
+	out, err := executeQuickPython(fmt.Sprintf("from %s import %s;pkg=%s();%s;pkg.cwd='%s';pkg.test()", pkg, pkg, pkg, prefixAssignment(), workspaceDir(pkg)), barrells)
 	if err != nil || !strings.Contains(out, "True") {
 		spinner.StopFailMessage(color.RedString("Failed Testing %s", pkg))
 		spinner.StopFail()
@@ -138,7 +159,9 @@ func test(pkg string, barrells string) bool {
 	return true
 
 }
-func installPKG(pkg string, barrells string) {
+
+// installPKG runs the prebuild install of pkg from its workspace
+func installPKG(pkg string, barrells string) error {
 	spinner, err := yacspin.New(yacspin.Config{
 		CharSet:           yacspin.CharSets[57],
 		Frequency:         time.Millisecond * 100,
@@ -161,14 +184,36 @@ func installPKG(pkg string, barrells string) {
 			return
 		}
 		spinner.Message(fmt.Sprintf("Installing Binary %s", *binary))
-		os.Symlink(fmt.Sprintf("/tmp/fermenter/%s/%s", pkg, *binary), fmt.Sprintf("/usr/local/bin/%s", *binary))
+		os.MkdirAll(prefixPath("bin"), 0755)
+		os.Symlink(fmt.Sprintf("%s/%s", workspaceDir(pkg), *binary), prefixPath("bin", filepath.Base(*binary)))
 	}()
-	_, err = executeQuickPython(fmt.Sprintf("from %s import %s;pkg=%s();pkg.prebuild.cwd='/tmp/fermenter/%s';pkg.prebuild.install()", pkg, pkg, pkg, pkg), barrells)
+	code := fmt.Sprintf("from %s import %s;pkg=%s();%s;pkg.prebuild.cwd='%s';pkg.prebuild.install()", pkg, pkg, pkg, prefixAssignment(), workspaceDir(pkg))
+	if isolatedNetwork {
+		_, err = executeIsolatedPython(code, barrells)
+	} else {
+		_, err = executeQuickPython(code, barrells)
+	}
 	if err != nil {
-		panic(err)
+		spinner.StopFailMessage(color.RedString("Failed to install %s", pkg))
+		spinner.StopFail()
+		return err
 	}
 	spinner.StopMessage(color.GreenString("Successfully installed %s", pkg))
 	spinner.Stop()
+	return nil
+}
+
+// uninstallPKG runs the uninstall of pkg and removes the binary linked into the prefix by installPKG
+func uninstallPKG(pkg string, barrells string) {
+	executeQuickPython(fmt.Sprintf("import os;from %s import %s;pkg=%s();%s;pkg.cwd='%s/';pkg.uninstall()", pkg, pkg, pkg, prefixAssignment(), workspaceDir(pkg)), barrells)
+	binary := checkIfBinaryRequired(pkg, barrells)
+	if binary == nil {
+		return
+	}
+	link := prefixPath("bin", filepath.Base(*binary))
+	if target, err := os.Readlink(link); err == nil && strings.HasPrefix(target, workspaceDir(pkg)+"/") {
+		os.Remove(link)
+	}
 }
 func checkIfBinaryRequired(pkg string, barrellsLoc string) *string {
 	path := fmt.Sprintf("%s/%s.py", barrellsLoc, pkg)
@@ -196,7 +241,7 @@ func checkIfBinaryRequired(pkg string, barrellsLoc string) *string {
 	return &out
 }
 func showLogs(pkg string) string {
-	os.Chdir(fmt.Sprintf("/tmp/fermenter/%s", pkg))
+	os.Chdir(workspaceDir(pkg))
 	logs, err := os.ReadFile(fmt.Sprintf("%s-build.log", pkg))
 	if err != nil {
 		return ""
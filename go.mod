@@ -7,7 +7,9 @@ require (
 	github.com/go-git/go-git/v5 v5.4.2
 	github.com/gorilla/websocket v1.5.0
 	github.com/graarh/golang-socketio v0.0.0-20170510162725-2c44953b9b5f
+	github.com/radovskyb/watcher v1.0.7
 	github.com/spf13/cobra v1.5.0
+	github.com/spf13/pflag v1.0.5
 	github.com/theckman/yacspin v0.13.12
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
 	github.com/zhouhui8915/go-socket.io-client v0.0.0-20200925034401-83ee73793ba4
@@ -28,10 +30,8 @@ require (
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
-	github.com/radovskyb/watcher v1.0.7 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/sergi/go-diff v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/xanzy/ssh-agent v0.3.0 // indirect
 	github.com/zhouhui8915/engine.io-go v0.0.0-20150910083302-02ea08f0971f // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect